@@ -46,3 +46,17 @@ func TestMinMax(t *testing.T) {
 		return
 	}
 }
+
+func TestUnary(t *testing.T) {
+	formula, err := New("-x + +3 - -(2*x) + !x + !0 + ^2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual := formula.Eval(Var("x", 4))
+	expected := -4.0 + 3.0 + 2.0*4.0 + 0.0 + 1.0 - 3.0
+	if expected != actual {
+		t.Errorf("expected formula result and Go result to be equal: expected: %v, actual: %v", expected, actual)
+		return
+	}
+}
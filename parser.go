@@ -49,6 +49,8 @@ func (p *astParser) parseExpr(e ast.Expr) (eval func(vars vars) float64, err err
 		eval, err = p.parseIdent(expr)
 	case *ast.BinaryExpr:
 		eval, err = p.parseBinaryExpr(expr)
+	case *ast.UnaryExpr:
+		eval, err = p.parseUnaryExpr(expr)
 	case *ast.ParenExpr:
 		eval, err = p.parseParenExpr(expr)
 	case *ast.CallExpr:
@@ -97,6 +99,39 @@ func (p *astParser) parseBinaryExpr(expr *ast.BinaryExpr) (eval func(vars vars)
 	return
 }
 
+// parseUnaryExpr parses a unary expression. This is an expression with an operator in front of a single
+// expression, such as a negation. The operators supported are -, +, ! (logical not, resulting in 1 if the
+// expression is 0 and 0 otherwise) and ^ (bitwise complement of the expression as an integer).
+func (p *astParser) parseUnaryExpr(expr *ast.UnaryExpr) (eval func(vars vars) float64, err error) {
+	x, err := p.parseExpr(expr.X)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse unary expression X: %v", err)
+	}
+
+	switch expr.Op {
+	case token.SUB:
+		eval = func(vars vars) float64 {
+			return -x(vars)
+		}
+	case token.ADD:
+		eval = x
+	case token.NOT:
+		eval = func(vars vars) float64 {
+			if x(vars) == 0 {
+				return 1
+			}
+			return 0
+		}
+	case token.XOR:
+		eval = func(vars vars) float64 {
+			return float64(^int64(x(vars)))
+		}
+	default:
+		return nil, fmt.Errorf("unknown unary operation '%v' (pos:%d)", expr.Op, int(expr.OpPos)-1)
+	}
+	return
+}
+
 // parseBasicLit parses a basic literal, provided the literal is a numeric one, like a float or an integer.
 // Both integers and floats are parsed as a float64.
 func (p *astParser) parseBasicLit(lit *ast.BasicLit) (func(vars vars) float64, error) {
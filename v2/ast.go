@@ -0,0 +1,214 @@
+package formula
+
+// Node is a node in the AST of a formula. It is one of *Number, *Ident, *Call, *Unary or *Binary.
+type Node interface {
+	// Pos returns the character position of the node in the formula.
+	Pos() int
+	// node makes sure no types outside of this package implement Node.
+	node()
+}
+
+// Number is a numeric literal, such as 3 or 1.5e3.
+type Number struct {
+	// ValuePos is the character position of the literal.
+	ValuePos int
+	// Literal is the literal as found in the formula.
+	Literal string
+	// Value is the value of the literal.
+	Value float64
+}
+
+// Ident is an identifier, which is either a variable or a constant.
+type Ident struct {
+	// NamePos is the character position of the identifier.
+	NamePos int
+	// Name is the name of the identifier.
+	Name string
+}
+
+// Call is a call to a function, or to a built-in conditional such as if.
+type Call struct {
+	// NamePos is the character position of the name of the function called.
+	NamePos int
+	// Name is the name of the function called.
+	Name string
+	// Args holds the arguments passed to the function.
+	Args []Node
+}
+
+// Unary is a unary expression: an operator applied to a single operand. The operator is either in front of
+// the operand (-x) or after it (x!).
+type Unary struct {
+	// OpPos is the character position of the operator.
+	OpPos int
+	// Op is the operator applied to X.
+	Op Op
+	// X is the operand.
+	X Node
+}
+
+// Binary is a binary expression: an operator applied to two operands.
+type Binary struct {
+	// OpPos is the character position of the operator. For implicit multiplications, such as 2x, it is the
+	// position of Y.
+	OpPos int
+	// Op is the operator applied to X and Y.
+	Op Op
+	// X and Y are the left and right operand.
+	X, Y Node
+}
+
+// Pos returns the character position of the literal.
+func (n *Number) Pos() int { return n.ValuePos }
+
+// Pos returns the character position of the identifier.
+func (n *Ident) Pos() int { return n.NamePos }
+
+// Pos returns the character position of the name of the function called.
+func (n *Call) Pos() int { return n.NamePos }
+
+// Pos returns the character position of the operator.
+func (n *Unary) Pos() int { return n.OpPos }
+
+// Pos returns the character position of the operator.
+func (n *Binary) Pos() int { return n.OpPos }
+
+func (*Number) node() {}
+func (*Ident) node()  {}
+func (*Call) node()   {}
+func (*Unary) node()  {}
+func (*Binary) node() {}
+
+// Op is an operator used in a unary or binary expression.
+type Op int
+
+const (
+	OpAdd  Op = iota + 1 // +
+	OpSub                // -
+	OpMul                // *
+	OpQuo                // /
+	OpRem                // %
+	OpPow                // ^
+	OpEql                // ==
+	OpNeq                // !=
+	OpLss                // <
+	OpLeq                // <=
+	OpGtr                // >
+	OpGeq                // >=
+	OpLAnd               // &&
+	OpLOr                // ||
+
+	OpNot       // !x
+	OpBitNot    // ^x
+	OpFactorial // x!
+)
+
+// opNames holds the notation of every operator.
+var opNames = [...]string{
+	OpAdd:       "+",
+	OpSub:       "-",
+	OpMul:       "*",
+	OpQuo:       "/",
+	OpRem:       "%",
+	OpPow:       "^",
+	OpEql:       "==",
+	OpNeq:       "!=",
+	OpLss:       "<",
+	OpLeq:       "<=",
+	OpGtr:       ">",
+	OpGeq:       ">=",
+	OpLAnd:      "&&",
+	OpLOr:       "||",
+	OpNot:       "!",
+	OpBitNot:    "^",
+	OpFactorial: "!",
+}
+
+// String returns the notation of the operator.
+func (op Op) String() string {
+	if op <= 0 || int(op) >= len(opNames) {
+		return "?"
+	}
+	return opNames[op]
+}
+
+// Visitor has its Visit method called for every node encountered by Walk. If the Visitor w returned is not
+// nil, Walk visits each of the children of the node with w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(n Node) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order: It starts by calling v.Visit(n). If the Visitor w returned by
+// v.Visit(n) is not nil, Walk is called recursively with w for each of the children of n, followed by a call
+// of w.Visit(nil).
+func Walk(v Visitor, n Node) {
+	if v = v.Visit(n); v == nil {
+		return
+	}
+	switch n := n.(type) {
+	case *Call:
+		for _, arg := range n.Args {
+			Walk(v, arg)
+		}
+	case *Unary:
+		Walk(v, n.X)
+	case *Binary:
+		Walk(v, n.X)
+		Walk(v, n.Y)
+	}
+	v.Visit(nil)
+}
+
+// inspector is a Visitor that calls a function for every node visited.
+type inspector func(Node) bool
+
+// Visit calls f with n and returns f if it returned true, or nil otherwise.
+func (f inspector) Visit(n Node) Visitor {
+	if f(n) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: It starts by calling f(n), which must not be nil. If f
+// returns true, Inspect calls itself recursively for each of the children of n, followed by a call of
+// f(nil).
+//
+// Example:
+//
+//  // Count the number of calls in a formula.
+//  calls := 0
+//  formula.Inspect(f.AST(), func(n formula.Node) bool {
+//     if _, ok := n.(*formula.Call); ok {
+//        calls++
+//     }
+//     return true
+//  })
+//
+func Inspect(n Node, f func(Node) bool) {
+	Walk(inspector(f), n)
+}
+
+// tooDeep returns the first node in the AST with n as root that is nested deeper than max levels, n being at
+// the first level, or nil if no node is. Nodes below max levels are never visited, so that the AST is walked
+// at most max levels deep.
+func tooDeep(n Node, max int) Node {
+	if max == 0 {
+		return n
+	}
+	var children []Node
+	switch n := n.(type) {
+	case *Call:
+		children = n.Args
+	case *Unary:
+		children = []Node{n.X}
+	case *Binary:
+		children = []Node{n.X, n.Y}
+	}
+	for _, child := range children {
+		if deep := tooDeep(child, max-1); deep != nil {
+			return deep
+		}
+	}
+	return nil
+}
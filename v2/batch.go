@@ -0,0 +1,662 @@
+package formula
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// batchSize is the number of rows evaluated at once by a batchEvaluator. Every node of the formula is
+// evaluated for all rows in a chunk of this size before moving on to the next node.
+const batchSize = 512
+
+// batchEvaluator is a function that evaluates (part of) a formula for the rows in sel of the current chunk
+// of a batch, writing the results for these rows into out. The indices in sel are relative to the start of
+// the chunk, as are the indices of out, and sorted in ascending order.
+//
+// If evaluating a row fails, the failure is recorded using batchState.fail and evaluation continues for the
+// rows before it, as one of these may still fail in a node evaluated later. An error is only returned if the
+// evaluation of the whole batch must stop, such as when it is canceled.
+type batchEvaluator func(b *batchState, sel []int, out []float64) error
+
+// batchState holds the state of the evaluation of a batch of rows.
+type batchState struct {
+	// columns holds the column of values for every slot, or nil if no column was passed for the slot.
+	columns [][]float64
+	// values and known hold the values of constants for slots without a column.
+	values []float64
+	known  []bool
+	// ctx is the context passed to EvalBatchContext, or context.Background(). done is the channel returned by
+	// ctx.Done().
+	ctx  context.Context
+	done <-chan struct{}
+	// base is the index of the first row of the chunk currently evaluated.
+	base int
+	// err is the error of the lowest row of the current chunk that failed, or nil if no row failed. failed is
+	// the index of that row, relative to the start of the chunk.
+	err    error
+	failed int
+	// row is the index of the row for which a function is currently called.
+	row int
+	// call is the call of the function currently being executed, or nil if no function is executed.
+	call *Call
+	// args holds the arguments of the function currently called.
+	args []float64
+	// argValues is a stack holding the buffers with the values of the arguments of the functions called.
+	argValues [][]float64
+	// buffers and selections hold buffers for intermediate results and selections that may be reused.
+	buffers    [][]float64
+	selections [][]int
+}
+
+// batchStatePool holds batchStates that may be reused for evaluations of batches.
+var batchStatePool = sync.Pool{New: func() interface{} {
+	return &batchState{args: make([]float64, 0, 16)}
+}}
+
+// buffer returns a buffer of batchSize values. It should be released using release once it is no longer used.
+func (b *batchState) buffer() []float64 {
+	if n := len(b.buffers); n != 0 {
+		buf := b.buffers[n-1]
+		b.buffers = b.buffers[:n-1]
+		return buf
+	}
+	return make([]float64, batchSize)
+}
+
+// release returns a buffer obtained using buffer, so that it may be reused.
+func (b *batchState) release(buf []float64) {
+	b.buffers = append(b.buffers, buf)
+}
+
+// selection returns an empty selection with a capacity of batchSize rows. It should be released using
+// releaseSelection once it is no longer used.
+func (b *batchState) selection() []int {
+	if n := len(b.selections); n != 0 {
+		sel := b.selections[n-1]
+		b.selections = b.selections[:n-1]
+		return sel[:0]
+	}
+	return make([]int, 0, batchSize)
+}
+
+// releaseSelection returns a selection obtained using selection, so that it may be reused.
+func (b *batchState) releaseSelection(sel []int) {
+	b.selections = append(b.selections, sel)
+}
+
+// fail records that the row i of the current chunk failed with the error passed, unless a lower row already
+// failed. The row is then no longer evaluated, as are the rows after it.
+func (b *batchState) fail(i int, err error) {
+	if b.err == nil || i < b.failed {
+		b.err, b.failed = err, i
+	}
+}
+
+// active returns the rows of sel that are still evaluated, which are the rows before the lowest row that
+// failed.
+func (b *batchState) active(sel []int) []int {
+	if b.err == nil {
+		return sel
+	}
+	return sel[:sort.SearchInts(sel, b.failed)]
+}
+
+// rowError wraps the error passed with the row of the batch it occurred in.
+func rowError(row int, err error) error {
+	return xerrors.Errorf("error evaluating row %v: %w", row, err)
+}
+
+// EvalBatch evaluates the formula for every row of the columns passed and writes the results into out. The
+// columns are indexed by the name of the variable they hold the values of, so that the result of row i is
+// written to out[i] as if Eval was called with the variables columns[name][i]. Like variables passed to Eval,
+// a column may over-ride a constant.
+//
+// Instead of evaluating the formula row by row, every operation in the formula is performed on many rows at
+// once. Like with Eval, the value not selected by if or ifs and the right operand of && and || are only
+// evaluated for the rows that need them. Formulas with a maximum number of operations, as set using
+// WithMaxOps, are evaluated row by row instead, so that the maximum applies to every row.
+//
+// Every column used by the formula must hold exactly len(out) values. Columns not used by the formula are
+// ignored. If evaluating a row fails, the error returned holds the row and wraps the error that Eval would
+// have returned for it. If multiple rows fail, the error of the row with the lowest index is returned.
+// Functions may still have been called for the rows after it.
+//
+// Example:
+//
+//  out := make([]float64, len(prices))
+//  err := f.EvalBatch(out, map[string][]float64{
+//     "price":    prices,
+//     "quantity": quantities,
+//  })
+//
+func (formula *Formula) EvalBatch(out []float64, columns map[string][]float64) error {
+	return formula.evalBatch(context.Background(), out, columns, 1)
+}
+
+// EvalBatchContext evaluates the formula for every row of the columns passed like EvalBatch, but stops
+// evaluating once the context passed is canceled or its deadline is exceeded. The context is checked before
+// every chunk of rows and before every function called for a chunk. If the evaluation was stopped, the error
+// returned holds the row and wraps ErrCanceled, like EvalContext.
+//
+// Functions registered using RegisterFuncContext receive the context passed.
+func (formula *Formula) EvalBatchContext(ctx context.Context, out []float64, columns map[string][]float64) error {
+	if err := ctx.Err(); err != nil {
+		return &ErrCanceled{Pos: 0, Err: err}
+	}
+	return formula.evalBatch(ctx, out, columns, 1)
+}
+
+// EvalBatchParallel evaluates the formula for every row of the columns passed like EvalBatch, but splits the
+// rows over the number of goroutines passed. If workers is 0 or less, runtime.GOMAXPROCS(0) goroutines are
+// used. Like with EvalBatch, the error of the failing row with the lowest index is returned.
+func (formula *Formula) EvalBatchParallel(out []float64, columns map[string][]float64, workers int) error {
+	return formula.evalBatch(context.Background(), out, columns, workers)
+}
+
+// evalBatch evaluates the formula for every row of the columns passed using the number of goroutines passed,
+// stopping once ctx is canceled.
+func (formula *Formula) evalBatch(ctx context.Context, out []float64, columns map[string][]float64, workers int) error {
+	prog := formula.compiled()
+	cols := make([][]float64, len(formula.slots))
+	exact := false
+	for name, column := range columns {
+		slot, ok := formula.slots[name]
+		if !ok {
+			continue
+		}
+		if len(column) != len(out) {
+			return xerrors.Errorf("column %v holds %v values, expected %v", name, len(column), len(out))
+		}
+		cols[slot] = column
+		exact = exact || prog.folded[slot]
+	}
+	eval := formula.batchEvaluator(prog, exact)
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	// Split the rows in ranges of whole chunks, so that every goroutine evaluates full chunks.
+	chunks := (len(out) + batchSize - 1) / batchSize
+	if workers > chunks {
+		workers = chunks
+	}
+	if workers <= 1 {
+		return formula.runBatch(ctx, eval, prog, cols, out, 0)
+	}
+	perWorker := (chunks + workers - 1) / workers * batchSize
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		start, end := i*perWorker, (i+1)*perWorker
+		if end > len(out) {
+			end = len(out)
+		}
+		if start >= end {
+			break
+		}
+		wg.Add(1)
+		go func(i, start, end int) {
+			defer wg.Done()
+			errs[i] = formula.runBatch(ctx, eval, prog, cols, out[start:end], start)
+		}(i, start, end)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchEvaluator returns the batchEvaluator of the program passed, compiling it if it was not yet compiled.
+// If exact is true, the evaluator of the AST without folded constants is returned. If the formula has a
+// maximum number of operations, the batchEvaluator returned evaluates every row separately, so that the
+// operations of every row are counted.
+func (formula *Formula) batchEvaluator(prog *program, exact bool) batchEvaluator {
+	if formula.maxOps > 0 {
+		return func(b *batchState, sel []int, out []float64) error {
+			for _, i := range sel {
+				var err error
+				if out[i], err = formula.evalRow(b.ctx, prog, b.columns, b.base+i); err != nil {
+					b.fail(i, err)
+					return nil
+				}
+			}
+			return nil
+		}
+	}
+	// The ASTs were compiled successfully before, so compiling them again cannot fail.
+	if exact {
+		prog.exactBatchOnce.Do(func() {
+			c := &batchCompiler{functions: prog.defs.functions, slots: formula.slots, strict: formula.strict}
+			prog.exactBatch, _ = c.compile(formula.root)
+		})
+		return prog.exactBatch
+	}
+	prog.batchOnce.Do(func() {
+		c := &batchCompiler{functions: prog.defs.functions, slots: formula.slots, strict: formula.strict}
+		prog.batch, _ = c.compile(prog.root)
+	})
+	return prog.batch
+}
+
+// runBatch evaluates the rows of out in chunks of batchSize rows, stopping once ctx is canceled. The first
+// row of out is row base of the columns passed.
+func (formula *Formula) runBatch(ctx context.Context, eval batchEvaluator, prog *program, columns [][]float64, out []float64, base int) (rerr error) {
+	b := batchStatePool.Get().(*batchState)
+	b.columns, b.values, b.known, b.ctx, b.done = columns, prog.values, prog.known, ctx, ctx.Done()
+	defer func() {
+		b.columns, b.values, b.known, b.ctx, b.done, b.err = nil, nil, nil, nil, nil, nil
+		b.call, b.args, b.argValues = nil, b.args[:0], b.argValues[:0]
+		batchStatePool.Put(b)
+	}()
+
+	sel := b.selection()
+	defer b.releaseSelection(sel)
+	for start := 0; start < len(out); start += batchSize {
+		end := start + batchSize
+		if end > len(out) {
+			end = len(out)
+		}
+		sel = sel[:0]
+		for i := 0; i < end-start; i++ {
+			sel = append(sel, i)
+		}
+		b.base = base + start
+		if err := b.interrupted(0); err != nil {
+			return rowError(b.base, err)
+		}
+		if err := eval(b, sel, out[start:end]); err != nil {
+			return err
+		}
+		if b.err != nil {
+			// The rows of earlier chunks did not fail, so this is the lowest row that failed.
+			return rowError(b.base+b.failed, b.err)
+		}
+	}
+	return nil
+}
+
+// interrupted checks if the context of the evaluation was canceled. If so, ErrCanceled is returned with the
+// position passed.
+func (b *batchState) interrupted(pos int) error {
+	select {
+	case <-b.done:
+		return &ErrCanceled{Pos: pos, Err: b.ctx.Err()}
+	default:
+		return nil
+	}
+}
+
+// evalRow evaluates a single row of the columns passed, like EvalContext.
+func (formula *Formula) evalRow(ctx context.Context, prog *program, columns [][]float64, row int) (float64, error) {
+	s := newState(prog)
+	s.ctx, s.done = ctx, ctx.Done()
+	for slot, column := range columns {
+		if column != nil {
+			s.setValue(slot, column[row])
+		}
+	}
+	return formula.run(prog, s)
+}
+
+// batchCompiler compiles the AST of a formula into a batchEvaluator.
+type batchCompiler struct {
+	// functions is a map of functions that may be executed by the formula, indexed by their names.
+	functions map[string]availableFunc
+	// slots maps the name of every identifier in the formula to the index of its slot.
+	slots map[string]int
+	// strict specifies if the formula is evaluated in strict math mode, as enabled using WithStrictMath.
+	strict bool
+}
+
+// compile compiles the node passed into a batchEvaluator. In strict math mode, the results of the node are
+// checked to be finite.
+func (c *batchCompiler) compile(n Node) (batchEvaluator, error) {
+	eval, err := c.compileNode(n)
+	if err != nil || !c.strict {
+		return eval, err
+	}
+	return func(b *batchState, sel []int, out []float64) error {
+		if err := eval(b, sel, out); err != nil {
+			return err
+		}
+		for _, i := range b.active(sel) {
+			if err := checkFinite(n, out[i]); err != nil {
+				b.fail(i, err)
+				break
+			}
+		}
+		return nil
+	}, nil
+}
+
+// compileNode compiles the node passed into a batchEvaluator, depending on its type.
+func (c *batchCompiler) compileNode(n Node) (batchEvaluator, error) {
+	switch n := n.(type) {
+	case *Number:
+		value := n.Value
+		return func(b *batchState, sel []int, out []float64) error {
+			for _, i := range sel {
+				out[i] = value
+			}
+			return nil
+		}, nil
+	case *Ident:
+		return c.compileIdent(n), nil
+	case *Unary:
+		return c.compileUnary(n)
+	case *Binary:
+		return c.compileBinary(n)
+	case *Call:
+		return c.compileCall(n)
+	}
+	return nil, fmt.Errorf("cannot parse unknown expression %T", n)
+}
+
+// compileIdent compiles an identifier, which holds the values of its column or the value of a constant.
+func (c *batchCompiler) compileIdent(n *Ident) batchEvaluator {
+	slot := c.slots[n.Name]
+	return func(b *batchState, sel []int, out []float64) error {
+		if len(sel) == 0 {
+			return nil
+		}
+		if column := b.columns[slot]; column != nil {
+			column = column[b.base:]
+			for _, i := range sel {
+				out[i] = column[i]
+			}
+			return nil
+		}
+		if !b.known[slot] {
+			b.fail(sel[0], &ErrUnknownVariable{Var: n.Name, Pos: n.NamePos})
+			return nil
+		}
+		value := b.values[slot]
+		for _, i := range sel {
+			out[i] = value
+		}
+		return nil
+	}
+}
+
+// compileUnary compiles a unary expression.
+func (c *batchCompiler) compileUnary(n *Unary) (batchEvaluator, error) {
+	x, err := c.compile(n.X)
+	if err != nil {
+		return nil, err
+	}
+	switch n.Op {
+	case OpAdd:
+		return x, nil
+	case OpSub, OpNot, OpBitNot, OpFactorial:
+	default:
+		return nil, fmt.Errorf("unknown unary operation '%v' (pos:%d)", n.Op, n.OpPos)
+	}
+	op := n.Op
+	return func(b *batchState, sel []int, out []float64) error {
+		if err := x(b, sel, out); err != nil {
+			return err
+		}
+		sel = b.active(sel)
+		switch op {
+		case OpSub:
+			for _, i := range sel {
+				out[i] = -out[i]
+			}
+		case OpNot:
+			for _, i := range sel {
+				out[i] = boolToFloat64(out[i] == 0)
+			}
+		case OpBitNot:
+			for _, i := range sel {
+				out[i] = float64(^int64(out[i]))
+			}
+		case OpFactorial:
+			for _, i := range sel {
+				out[i] = math.Gamma(out[i] + 1)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// compileBinary compiles a binary expression. For the logical operators, Y is only evaluated for the rows
+// that need it.
+func (c *batchCompiler) compileBinary(n *Binary) (batchEvaluator, error) {
+	x, err := c.compile(n.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := c.compile(n.Y)
+	if err != nil {
+		return nil, err
+	}
+	op, strict := n.Op, c.strict
+	switch op {
+	case OpLAnd, OpLOr:
+		// Rows for which X is equal to short are short-circuited.
+		short := op == OpLOr
+		return func(b *batchState, sel []int, out []float64) error {
+			if err := x(b, sel, out); err != nil {
+				return err
+			}
+			rest := b.selection()
+			defer b.releaseSelection(rest)
+			for _, i := range b.active(sel) {
+				if (out[i] != 0) == short {
+					out[i] = boolToFloat64(short)
+				} else {
+					rest = append(rest, i)
+				}
+			}
+			if err := y(b, rest, out); err != nil {
+				return err
+			}
+			for _, i := range b.active(rest) {
+				out[i] = boolToFloat64(out[i] != 0)
+			}
+			return nil
+		}, nil
+	case OpAdd, OpSub, OpMul, OpQuo, OpRem, OpPow, OpEql, OpNeq, OpLss, OpLeq, OpGtr, OpGeq:
+	default:
+		return nil, fmt.Errorf("unknown mathematical operation '%v' (pos:%d)", op, n.OpPos)
+	}
+	return func(b *batchState, sel []int, out []float64) error {
+		if err := x(b, sel, out); err != nil {
+			return err
+		}
+		ys := b.buffer()
+		defer b.release(ys)
+		if err := y(b, b.active(sel), ys); err != nil {
+			return err
+		}
+		sel = b.active(sel)
+		if strict && (op == OpQuo || op == OpRem) {
+			for _, i := range sel {
+				if ys[i] == 0 {
+					b.fail(i, &ErrDivisionByZero{Pos: n.OpPos})
+					sel = b.active(sel)
+					break
+				}
+			}
+		}
+		switch op {
+		case OpAdd:
+			for _, i := range sel {
+				out[i] += ys[i]
+			}
+		case OpSub:
+			for _, i := range sel {
+				out[i] -= ys[i]
+			}
+		case OpMul:
+			for _, i := range sel {
+				out[i] *= ys[i]
+			}
+		case OpQuo:
+			for _, i := range sel {
+				out[i] /= ys[i]
+			}
+		case OpRem:
+			for _, i := range sel {
+				out[i] = math.Mod(out[i], ys[i])
+			}
+		case OpPow:
+			for _, i := range sel {
+				out[i] = math.Pow(out[i], ys[i])
+			}
+		case OpEql:
+			for _, i := range sel {
+				out[i] = boolToFloat64(out[i] == ys[i])
+			}
+		case OpNeq:
+			for _, i := range sel {
+				out[i] = boolToFloat64(out[i] != ys[i])
+			}
+		case OpLss:
+			for _, i := range sel {
+				out[i] = boolToFloat64(out[i] < ys[i])
+			}
+		case OpLeq:
+			for _, i := range sel {
+				out[i] = boolToFloat64(out[i] <= ys[i])
+			}
+		case OpGtr:
+			for _, i := range sel {
+				out[i] = boolToFloat64(out[i] > ys[i])
+			}
+		case OpGeq:
+			for _, i := range sel {
+				out[i] = boolToFloat64(out[i] >= ys[i])
+			}
+		}
+		return nil
+	}, nil
+}
+
+// compileCall compiles a call to a function or a built-in conditional. Functions are called once for every
+// row, with the arguments of that row.
+func (c *batchCompiler) compileCall(n *Call) (batchEvaluator, error) {
+	args := make([]batchEvaluator, len(n.Args))
+	for i, arg := range n.Args {
+		eval, err := c.compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing function parameter: %v", err)
+		}
+		args[i] = eval
+	}
+	switch n.Name {
+	case "if", "ifs":
+		if err := checkConditional(n); err != nil {
+			return nil, err
+		}
+		return conditionalBatch(args), nil
+	}
+	p := &astParser{functions: c.functions}
+	f, err := p.function(n)
+	if err != nil {
+		return func(b *batchState, sel []int, out []float64) error {
+			if len(sel) == 0 {
+				return nil
+			}
+			b.fail(sel[0], err)
+			return nil
+		}, nil
+	}
+	function, contextFunction := f.function, f.contextFunction
+	return func(b *batchState, sel []int, out []float64) error {
+		if len(sel) == 0 {
+			return nil
+		}
+		// The buffers holding the values of the arguments are pushed onto b.argValues, so that no slice needs
+		// to be allocated for them.
+		valuesStart, start := len(b.argValues), len(b.args)
+		defer func() {
+			// A panic only stops the row it occurred in, like an error returned by the function.
+			if r := recover(); r != nil {
+				b.fail(b.row-b.base, panicError(b.call, r))
+			}
+			b.args, b.call = b.args[:start], nil
+			for _, v := range b.argValues[valuesStart:] {
+				b.release(v)
+			}
+			b.argValues = b.argValues[:valuesStart]
+		}()
+		for _, arg := range args {
+			buf := b.buffer()
+			b.argValues = append(b.argValues, buf)
+			if err := arg(b, b.active(sel), buf); err != nil {
+				return err
+			}
+		}
+		if sel = b.active(sel); len(sel) == 0 {
+			return nil
+		}
+		if b.done != nil {
+			if err := b.interrupted(n.NamePos); err != nil {
+				return rowError(b.base+sel[0], err)
+			}
+		}
+		values := b.argValues[valuesStart:]
+		for _, i := range sel {
+			b.args = b.args[:start]
+			for _, v := range values {
+				b.args = append(b.args, v[i])
+			}
+			b.row, b.call = b.base+i, n
+			if contextFunction == nil {
+				out[i] = function(b.args[start:]...)
+				continue
+			}
+			var err error
+			if out[i], err = contextFunction(b.ctx, b.args[start:]...); err != nil {
+				b.fail(i, &ErrFunc{Func: n.Name, Pos: n.NamePos, Err: err})
+				break
+			}
+		}
+		return nil
+	}, nil
+}
+
+// conditionalBatch returns a batchEvaluator for a call to if or ifs with the arguments passed. Every row is
+// only evaluated by the conditions up to the one met for the row and by the value selected.
+func conditionalBatch(args []batchEvaluator) batchEvaluator {
+	return func(b *batchState, sel []int, out []float64) error {
+		// remaining holds the rows for which no condition was met yet.
+		remaining, rest, matched := b.selection(), b.selection(), b.selection()
+		defer func() {
+			b.releaseSelection(remaining)
+			b.releaseSelection(rest)
+			b.releaseSelection(matched)
+		}()
+		remaining = append(remaining, sel...)
+		conds := b.buffer()
+		defer b.release(conds)
+		for i := 0; i < len(args)-1 && len(remaining) != 0; i += 2 {
+			if err := args[i](b, b.active(remaining), conds); err != nil {
+				return err
+			}
+			rest, matched = rest[:0], matched[:0]
+			for _, row := range b.active(remaining) {
+				if conds[row] != 0 {
+					matched = append(matched, row)
+				} else {
+					rest = append(rest, row)
+				}
+			}
+			if err := args[i+1](b, matched, out); err != nil {
+				return err
+			}
+			remaining, rest = rest, remaining
+		}
+		return args[len(args)-1](b, b.active(remaining), out)
+	}
+}
@@ -0,0 +1,75 @@
+package formula
+
+import (
+	"golang.org/x/xerrors"
+)
+
+// Binding is a formula bound to a fixed list of variable names, created using Formula.Bind. The variables are
+// looked up once when binding, so that evaluating the formula using a Binding does not need to look up any
+// names and does not allocate.
+//
+// A Binding is safe to use concurrently from multiple goroutines. It keeps working if functions or constants
+// are registered to the formula after it was created.
+type Binding struct {
+	formula *Formula
+	names   []string
+	// slots holds the slot of every variable name, or -1 if the formula does not use the variable.
+	slots []int
+}
+
+// Bind binds the formula to the variable names passed. The Binding returned evaluates the formula with
+// values passed in the same order as the names. Names of variables that are not used in the formula are
+// allowed: Their values are ignored. Like variables passed to Eval, a name may over-ride a constant.
+//
+// Example:
+//
+//  f, _ := formula.New("x^2 + y")
+//  b := f.Bind("x", "y")
+//  for i := 0; i < 100; i++ {
+//     v, _ := b.Eval(float64(i), 1)
+//     fmt.Println(v)
+//  }
+//
+func (formula *Formula) Bind(names ...string) *Binding {
+	b := &Binding{formula: formula, names: append([]string(nil), names...), slots: make([]int, len(names))}
+	for i, name := range names {
+		slot, ok := formula.slots[name]
+		if !ok {
+			slot = -1
+		}
+		b.slots[i] = slot
+	}
+	return b
+}
+
+// Names returns the variable names that the Binding was created with.
+func (b *Binding) Names() []string {
+	return append([]string(nil), b.names...)
+}
+
+// Eval evaluates the formula with the values passed assigned to the variables the Binding was created with.
+// The number of values must be equal to the number of names passed to Bind, otherwise an error is returned.
+// Other errors are returned like Formula.Eval.
+func (b *Binding) Eval(values ...float64) (float64, error) {
+	if len(values) != len(b.slots) {
+		return 0, xerrors.Errorf("expected %v values for variables %v, got %v", len(b.slots), b.names, len(values))
+	}
+	formula := b.formula
+	prog := formula.compiled()
+	s := newState(prog)
+	for i, slot := range b.slots {
+		if slot != -1 {
+			s.setValue(slot, values[i])
+		}
+	}
+	return formula.run(prog, s)
+}
+
+// MustEval calls Eval but panics if Eval returns an error.
+func (b *Binding) MustEval(values ...float64) float64 {
+	f, err := b.Eval(values...)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
@@ -0,0 +1,193 @@
+package formula
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FuncInfo holds information about a function available in formulas, as returned by Environment.Functions.
+// It may be used to list the functions available to users of an application, for example for auto-completion
+// or help text in a formula editor.
+type FuncInfo struct {
+	// Name is the name of the function.
+	Name string
+	// Description is a short description of the function, or an empty string if it has none.
+	Description string
+	// Params holds the names of the parameters of the function, or nil if these are not known. If Variadic is
+	// true, more arguments may be passed after these parameters.
+	Params []string
+	// MinArgs is the minimum number of arguments that must be passed to the function.
+	MinArgs int
+	// MaxArgs is the maximum number of arguments that may be passed to the function, or Variadic if any
+	// number of arguments may be passed.
+	MaxArgs int
+	// Variadic specifies if any number of arguments may be passed to the function.
+	Variadic bool
+	// Pure specifies if the function is pure, as set using SetPure.
+	Pure bool
+}
+
+// Signature returns the signature of the function as it may be written in a formula, such as pow(x, y).
+// Parameters that are optional are put in brackets and parameters without a name are named after their index,
+// such as x1. If any number of arguments may be passed, the signature ends with ..., such as max(x, ...).
+func (info FuncInfo) Signature() string {
+	n := info.MinArgs
+	if !info.Variadic && info.MaxArgs > n {
+		n = info.MaxArgs
+	}
+	if len(info.Params) > n {
+		n = len(info.Params)
+	}
+	params := make([]string, n, n+1)
+	for i := range params {
+		name := fmt.Sprintf("x%v", i+1)
+		if i < len(info.Params) {
+			name = info.Params[i]
+		}
+		if i >= info.MinArgs {
+			name = "[" + name + "]"
+		}
+		params[i] = name
+	}
+	if info.Variadic {
+		params = append(params, "...")
+	}
+	return info.Name + "(" + strings.Join(params, ", ") + ")"
+}
+
+// funcDescription is the description and parameter names of a function, as set using Describe.
+type funcDescription struct {
+	description string
+	params      []string
+}
+
+// builtinFunctions holds the FuncInfo of the built-in conditionals, which are available in every formula.
+var builtinFunctions = []FuncInfo{
+	{Name: "if", Description: "Returns then if cond is not 0, otherwise else. Only the value returned is evaluated.", Params: []string{"cond", "then", "else"}, MinArgs: 3, MaxArgs: 3, Pure: true},
+	{Name: "ifs", Description: "Returns the value of the first cond that is not 0, otherwise else. Only the value returned is evaluated.", Params: []string{"cond", "value", "else"}, MinArgs: 3, MaxArgs: Variadic, Variadic: true, Pure: true},
+}
+
+// defaultDescriptions holds the descriptions and parameter names of the default functions.
+var defaultDescriptions = map[string]funcDescription{
+	"abs":         {"Returns the absolute value of x.", []string{"x"}},
+	"acos":        {"Returns the arccosine, in radians, of x.", []string{"x"}},
+	"acosh":       {"Returns the inverse hyperbolic cosine of x.", []string{"x"}},
+	"asin":        {"Returns the arcsine, in radians, of x.", []string{"x"}},
+	"asinh":       {"Returns the inverse hyperbolic sine of x.", []string{"x"}},
+	"atan":        {"Returns the arctangent, in radians, of x.", []string{"x"}},
+	"atan2":       {"Returns the arctangent of y/x, using the signs of the two to determine the quadrant.", []string{"y", "x"}},
+	"atanh":       {"Returns the inverse hyperbolic tangent of x.", []string{"x"}},
+	"cbrt":        {"Returns the cube root of x.", []string{"x"}},
+	"ceil":        {"Returns the least integer value greater than or equal to x.", []string{"x"}},
+	"copysign":    {"Returns a value with the magnitude of x and the sign of y.", []string{"x", "y"}},
+	"cos":         {"Returns the cosine of the radian argument x.", []string{"x"}},
+	"cosh":        {"Returns the hyperbolic cosine of x.", []string{"x"}},
+	"dim":         {"Returns the maximum of x-y or 0.", []string{"x", "y"}},
+	"erf":         {"Returns the error function of x.", []string{"x"}},
+	"erfc":        {"Returns the complementary error function of x.", []string{"x"}},
+	"erfcinv":     {"Returns the inverse of erfc(x).", []string{"x"}},
+	"erfinv":      {"Returns the inverse error function of x.", []string{"x"}},
+	"exp":         {"Returns e**x, the base-e exponential of x.", []string{"x"}},
+	"exp2":        {"Returns 2**x, the base-2 exponential of x.", []string{"x"}},
+	"expm1":       {"Returns e**x - 1, the base-e exponential of x minus 1.", []string{"x"}},
+	"floor":       {"Returns the greatest integer value less than or equal to x.", []string{"x"}},
+	"fma":         {"Returns x * y + z, computed with only one rounding.", []string{"x", "y", "z"}},
+	"gamma":       {"Returns the Gamma function of x.", []string{"x"}},
+	"hypot":       {"Returns sqrt(p*p + q*q).", []string{"p", "q"}},
+	"j0":          {"Returns the order-zero Bessel function of the first kind.", []string{"x"}},
+	"j1":          {"Returns the order-one Bessel function of the first kind.", []string{"x"}},
+	"jn":          {"Returns the order-n Bessel function of the first kind.", []string{"n", "x"}},
+	"log":         {"Returns the natural logarithm of x.", []string{"x"}},
+	"log10":       {"Returns the decimal logarithm of x.", []string{"x"}},
+	"log1p":       {"Returns the natural logarithm of 1 plus x.", []string{"x"}},
+	"log2":        {"Returns the binary logarithm of x.", []string{"x"}},
+	"logb":        {"Returns the binary exponent of x.", []string{"x"}},
+	"max":         {"Returns the largest of the values passed.", []string{"x"}},
+	"min":         {"Returns the smallest of the values passed.", []string{"x"}},
+	"mod":         {"Returns the floating-point remainder of x/y.", []string{"x", "y"}},
+	"nextafter":   {"Returns the next representable value after x towards y.", []string{"x", "y"}},
+	"pow":         {"Returns x**y, the base-x exponential of y.", []string{"x", "y"}},
+	"pow10":       {"Returns 10**n, the base-10 exponential of n.", []string{"n"}},
+	"remainder":   {"Returns the IEEE 754 floating-point remainder of x/y.", []string{"x", "y"}},
+	"round":       {"Returns the nearest integer, rounding half away from zero.", []string{"x"}},
+	"roundtoeven": {"Returns the nearest integer, rounding ties to even.", []string{"x"}},
+	"sin":         {"Returns the sine of the radian argument x.", []string{"x"}},
+	"sinh":        {"Returns the hyperbolic sine of x.", []string{"x"}},
+	"sqrt":        {"Returns the square root of x.", []string{"x"}},
+	"tan":         {"Returns the tangent of the radian argument x.", []string{"x"}},
+	"tanh":        {"Returns the hyperbolic tangent of x.", []string{"x"}},
+	"trunc":       {"Returns the integer value of x.", []string{"x"}},
+	"y0":          {"Returns the order-zero Bessel function of the second kind.", []string{"x"}},
+	"y1":          {"Returns the order-one Bessel function of the second kind.", []string{"x"}},
+	"yn":          {"Returns the order-n Bessel function of the second kind.", []string{"n", "x"}},
+}
+
+// Describe sets the description and parameter names of the function with the name passed, as returned by
+// Functions. Registering a function again removes its description. Describe has no effect if no function with
+// the name is registered and panics if the Environment is frozen.
+//
+// Example:
+//
+//  env.RegisterFuncRange("clamp", 3, 3, clamp)
+//  env.Describe("clamp", "Limits x to the range [min, max].", "x", "min", "max")
+//
+func (env *Environment) Describe(name, description string, params ...string) {
+	env.modify(func(defs *definitions) {
+		if fn, ok := defs.functions[name]; ok {
+			fn.description, fn.params = description, append([]string(nil), params...)
+			defs.functions[name] = fn
+		}
+	})
+}
+
+// Function returns information about the function with the name passed. If no function with the name is
+// available, false is returned.
+func (env *Environment) Function(name string) (FuncInfo, bool) {
+	for _, info := range builtinFunctions {
+		if info.Name == name {
+			info.Params = append([]string(nil), info.Params...)
+			return info, true
+		}
+	}
+	fn, ok := env.definitions().functions[name]
+	if !ok {
+		return FuncInfo{}, false
+	}
+	return fn.info(name), true
+}
+
+// Functions returns information about all functions available in formulas using the Environment, including
+// the built-in conditionals if and ifs, sorted by their names.
+func (env *Environment) Functions() []FuncInfo {
+	defs := env.definitions()
+	infos := make([]FuncInfo, 0, len(defs.functions)+len(builtinFunctions))
+	for _, info := range builtinFunctions {
+		info.Params = append([]string(nil), info.Params...)
+		infos = append(infos, info)
+	}
+	for name, fn := range defs.functions {
+		if name == "if" || name == "ifs" {
+			// The built-in conditionals are always called instead.
+			continue
+		}
+		infos = append(infos, fn.info(name))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// info returns the FuncInfo of the function, which is registered with the name passed.
+func (f availableFunc) info(name string) FuncInfo {
+	return FuncInfo{
+		Name:        name,
+		Description: f.description,
+		Params:      append([]string(nil), f.params...),
+		MinArgs:     f.paramCount,
+		MaxArgs:     f.maxParamCount,
+		Variadic:    f.maxParamCount == Variadic,
+		Pure:        f.pure,
+	}
+}
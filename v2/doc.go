@@ -1,3 +1,3 @@
-// Package formula implements very simple but fast formula parsing and evaluating. It uses the AST package
-// to parse expressions in the formula which it transforms to executable functions.
+// Package formula implements very simple but fast formula parsing and evaluating. Formulas are parsed into an
+// AST using a dedicated parser, which is then transformed to executable functions.
 package formula
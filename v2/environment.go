@@ -0,0 +1,257 @@
+package formula
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/xerrors"
+)
+
+// Environment holds functions and constants that are available to formulas. An Environment is built once and
+// may then be shared by any number of formulas using WithEnvironment, so that the functions and constants do
+// not need to be registered to every formula separately.
+//
+// An Environment may be extended using Extend, which creates a new Environment holding the same functions and
+// constants. These are only copied once either Environment is modified, so extending an Environment is
+// cheap. An Environment may be frozen using Freeze, after which it can no longer be modified.
+//
+// An Environment is safe to use concurrently from multiple goroutines: Functions and constants may be
+// registered while formulas using the Environment are being evaluated.
+type Environment struct {
+	// mu serialises modifications of the Environment.
+	mu sync.Mutex
+	// defs holds the *definitions of the Environment. The definitions stored are never modified: They are
+	// copied, modified and stored again when the Environment is modified, so that they may be read without
+	// locking while the Environment is modified.
+	defs atomic.Value
+	// frozen is true if the Environment may no longer be modified.
+	frozen bool
+}
+
+// definitions is an immutable snapshot of the functions and constants held by an Environment.
+type definitions struct {
+	// functions holds the functions available, indexed by their names.
+	functions map[string]availableFunc
+	// constants holds the constants available, indexed by their names.
+	constants map[string]float64
+}
+
+var (
+	// defaultEnvironment is the Environment used by formulas created without WithEnvironment. It holds the
+	// default functions and constants.
+	defaultEnvironment = NewEnvironment().Freeze()
+	// emptyEnvironment is the Environment used by formulas created using WithoutDefaults.
+	emptyEnvironment = NewEmptyEnvironment().Freeze()
+)
+
+// NewEnvironment returns a new Environment holding the default functions, such as sin and pow, and the default
+// constants, such as π and e.
+func NewEnvironment() *Environment {
+	env := NewEmptyEnvironment()
+	env.registerDefaults()
+	return env
+}
+
+// NewEmptyEnvironment returns a new Environment without any functions or constants.
+func NewEmptyEnvironment() *Environment {
+	env := &Environment{}
+	env.defs.Store(&definitions{functions: make(map[string]availableFunc), constants: make(map[string]float64)})
+	return env
+}
+
+// RegisterFunc registers a custom function in the Environment. It works like Formula.RegisterFunc, but makes
+// the function available to all formulas using the Environment. RegisterFunc panics if the Environment is
+// frozen.
+func (env *Environment) RegisterFunc(name string, paramCount int, f func(args ...float64) float64) {
+	env.RegisterFuncRange(name, paramCount, Variadic, f)
+}
+
+// RegisterFuncRange registers a custom function with a maximum number of arguments in the Environment. It
+// works like Formula.RegisterFuncRange, but makes the function available to all formulas using the
+// Environment. RegisterFuncRange panics if the Environment is frozen.
+func (env *Environment) RegisterFuncRange(name string, paramCount, maxParamCount int, f func(args ...float64) float64) {
+	env.register(name, availableFunc{function: f, paramCount: paramCount, maxParamCount: maxParamCount})
+}
+
+// RegisterFuncContext registers a custom function in the Environment that receives the context passed to
+// Formula.EvalContext, or context.Background() if the formula is evaluated without a context. It otherwise
+// works like RegisterFuncRange. RegisterFuncContext panics if the Environment is frozen.
+func (env *Environment) RegisterFuncContext(name string, paramCount, maxParamCount int, f func(ctx context.Context, args ...float64) float64) {
+	env.register(name, availableFunc{contextFunction: withContext(f), paramCount: paramCount, maxParamCount: maxParamCount})
+}
+
+// RegisterFuncE registers a custom function in the Environment that may return an error. It works like
+// Formula.RegisterFuncE, but makes the function available to all formulas using the Environment.
+// RegisterFuncE panics if the Environment is frozen.
+func (env *Environment) RegisterFuncE(name string, paramCount, maxParamCount int, f func(args ...float64) (float64, error)) {
+	env.register(name, availableFunc{contextFunction: withError(f), paramCount: paramCount, maxParamCount: maxParamCount})
+}
+
+// RegisterGoFunc registers the Go function passed in the Environment. It works like Formula.RegisterGoFunc, but
+// makes the function available to all formulas using the Environment. RegisterGoFunc panics if the
+// Environment is frozen.
+func (env *Environment) RegisterGoFunc(name string, fn interface{}) error {
+	f, err := goFunc(fn)
+	if err != nil {
+		return xerrors.Errorf("cannot register func %v: %w", name, err)
+	}
+	env.register(name, f)
+	return nil
+}
+
+// register registers the function passed in the Environment with the name passed.
+func (env *Environment) register(name string, f availableFunc) {
+	env.modify(func(defs *definitions) {
+		defs.functions[name] = f
+	})
+}
+
+// SetPure marks the function with the name passed as pure or impure. A pure function always returns the same
+// result for the same arguments and has no side effects, so that calls with constant arguments, such as
+// sqrt(2), may be computed once when the formula is compiled instead of on every evaluation. The default
+// functions are pure, custom functions are impure until marked otherwise. Registering a function again
+// makes it impure. SetPure has no effect if no function with the name is registered and panics if the
+// Environment is frozen.
+func (env *Environment) SetPure(name string, pure bool) {
+	env.modify(func(defs *definitions) {
+		if fn, ok := defs.functions[name]; ok {
+			fn.pure = pure
+			defs.functions[name] = fn
+		}
+	})
+}
+
+// SetConstant sets a constant in the Environment. Like the default constants, it is available in formulas
+// using the Environment unless over-ridden by a variable with the same name. SetConstant panics if the
+// Environment is frozen.
+func (env *Environment) SetConstant(name string, value float64) {
+	env.modify(func(defs *definitions) {
+		defs.constants[name] = value
+	})
+}
+
+// Freeze freezes the Environment, so that it may no longer be modified. Freeze returns the Environment
+// itself, so that it may be used as NewEnvironment().Freeze(). A frozen Environment may still be extended
+// using Extend.
+func (env *Environment) Freeze() *Environment {
+	env.mu.Lock()
+	env.frozen = true
+	env.mu.Unlock()
+	return env
+}
+
+// Frozen checks if the Environment was frozen using Freeze.
+func (env *Environment) Frozen() bool {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	return env.frozen
+}
+
+// Extend returns a new Environment that is not frozen, holding all functions and constants of env. Modifying
+// the Environment returned does not affect env and vice versa.
+func (env *Environment) Extend() *Environment {
+	extended := &Environment{}
+	extended.defs.Store(env.definitions())
+	return extended
+}
+
+// definitions returns the current definitions of the Environment. The definitions returned must not be
+// modified.
+func (env *Environment) definitions() *definitions {
+	return env.defs.Load().(*definitions)
+}
+
+// modify modifies the Environment by calling f with a copy of its current definitions, which are then
+// stored as the new definitions of the Environment. It panics if the Environment is frozen.
+func (env *Environment) modify(f func(defs *definitions)) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	if env.frozen {
+		panic("formula: cannot modify frozen environment")
+	}
+	current := env.definitions()
+	defs := &definitions{
+		functions: make(map[string]availableFunc, len(current.functions)+1),
+		constants: make(map[string]float64, len(current.constants)+1),
+	}
+	for name, fn := range current.functions {
+		defs.functions[name] = fn
+	}
+	for name, value := range current.constants {
+		defs.constants[name] = value
+	}
+	f(defs)
+	env.defs.Store(defs)
+}
+
+// registerDefaults registers all functions found in the functions.go file and the default constants to the
+// environment. This is done for every environment created using NewEnvironment, and therefore for each formula
+// automatically, so these functions do not need to be added manually.
+func (env *Environment) registerDefaults() {
+	for name, value := range defaultConstants {
+		env.SetConstant(name, value)
+	}
+
+	env.RegisterFuncRange("abs", 1, 1, abs)
+	env.RegisterFuncRange("acos", 1, 1, acos)
+	env.RegisterFuncRange("acosh", 1, 1, acosh)
+	env.RegisterFuncRange("asin", 1, 1, asin)
+	env.RegisterFuncRange("asinh", 1, 1, asinh)
+	env.RegisterFuncRange("atan", 1, 1, atan)
+	env.RegisterFuncRange("atan2", 2, 2, atan2)
+	env.RegisterFuncRange("atanh", 1, 1, atanh)
+	env.RegisterFuncRange("cbrt", 1, 1, cbrt)
+	env.RegisterFuncRange("ceil", 1, 1, ceil)
+	env.RegisterFuncRange("copysign", 2, 2, copysign)
+	env.RegisterFuncRange("cos", 1, 1, cos)
+	env.RegisterFuncRange("cosh", 1, 1, cosh)
+	env.RegisterFuncRange("dim", 2, 2, dim)
+	env.RegisterFuncRange("erf", 1, 1, erf)
+	env.RegisterFuncRange("erfc", 1, 1, erfc)
+	env.RegisterFuncRange("erfcinv", 1, 1, erfcinv)
+	env.RegisterFuncRange("erfinv", 1, 1, erfinv)
+	env.RegisterFuncRange("exp", 1, 1, exp)
+	env.RegisterFuncRange("exp2", 1, 1, exp2)
+	env.RegisterFuncRange("expm1", 1, 1, expm1)
+	env.RegisterFuncRange("floor", 1, 1, floor)
+	env.RegisterFuncRange("gamma", 1, 1, gamma)
+	env.RegisterFuncRange("hypot", 2, 2, hypot)
+	env.RegisterFuncRange("j0", 1, 1, j0)
+	env.RegisterFuncRange("j1", 1, 1, j1)
+	env.RegisterFuncRange("jn", 2, 2, jn)
+	env.RegisterFuncRange("log", 1, 1, log)
+	env.RegisterFuncRange("log10", 1, 1, log10)
+	env.RegisterFuncRange("log1p", 1, 1, log1p)
+	env.RegisterFuncRange("log2", 1, 1, log2)
+	env.RegisterFuncRange("logb", 1, 1, logb)
+	env.RegisterFuncRange("max", 1, Variadic, max)
+	env.RegisterFuncRange("min", 1, Variadic, min)
+	env.RegisterFuncRange("mod", 2, 2, mod)
+	env.RegisterFuncRange("nextafter", 2, 2, nextafter)
+	env.RegisterFuncRange("pow", 2, 2, pow)
+	env.RegisterFuncRange("pow10", 1, 1, pow10)
+	env.RegisterFuncRange("remainder", 2, 2, remainder)
+	env.RegisterFuncRange("round", 1, 1, round)
+	env.RegisterFuncRange("roundtoeven", 1, 1, roundtoeven)
+	env.RegisterFuncRange("sin", 1, 1, sin)
+	env.RegisterFuncRange("sinh", 1, 1, sinh)
+	env.RegisterFuncRange("sqrt", 1, 1, sqrt)
+	env.RegisterFuncRange("tan", 1, 1, tan)
+	env.RegisterFuncRange("tanh", 1, 1, tanh)
+	env.RegisterFuncRange("trunc", 1, 1, trunc)
+	env.RegisterFuncRange("y0", 1, 1, y0)
+	env.RegisterFuncRange("y1", 1, 1, y1)
+	env.RegisterFuncRange("yn", 2, 2, yn)
+
+	env.registerExtra()
+
+	// All default functions are pure.
+	env.modify(func(defs *definitions) {
+		for name, fn := range defs.functions {
+			fn.pure = true
+			fn.description, fn.params = defaultDescriptions[name].description, defaultDescriptions[name].params
+			defs.functions[name] = fn
+		}
+	})
+}
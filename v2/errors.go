@@ -40,6 +40,23 @@ func (e *ErrInsufficientArgs) Error() string {
 	return fmt.Sprintf("insufficient args: %s (pos:%d)", e.Func, e.Pos)
 }
 
+// ErrTooManyArgs is returned when a function in a formula accepts fewer arguments than that provided.
+type ErrTooManyArgs struct {
+	// Func is the name of the function.
+	Func string
+	// Pos is the character position of Func.
+	Pos int
+	// Actual is the number of arguments provided to Func.
+	Actual int
+	// Expected is the maximum number of arguments accepted by Func.
+	Expected int
+}
+
+// Error implements error.
+func (e *ErrTooManyArgs) Error() string {
+	return fmt.Sprintf("too many args: %s (pos:%d)", e.Func, e.Pos)
+}
+
 // ErrUnknownFunc is returned when a formula contains an unrecognized function.
 type ErrUnknownFunc struct {
 	// Func is the name of the unknown function encountered.
@@ -65,3 +82,177 @@ type ErrUnknownVariable struct {
 func (e *ErrUnknownVariable) Error() string {
 	return fmt.Sprintf("unknown var: %s (pos:%d)", e.Var, e.Pos)
 }
+
+// ErrVariable is returned when the function computing the value of a lazy variable, passed using LazyVar,
+// returns an error.
+type ErrVariable struct {
+	// Var is the name of the variable.
+	Var string
+	// Pos is the character position of the variable where it was first evaluated.
+	Pos int
+	// Err is the error returned by the function computing the value of Var.
+	Err error
+}
+
+// Error implements error.
+func (e *ErrVariable) Error() string {
+	return fmt.Sprintf("error computing var: %s (pos:%d): %v", e.Var, e.Pos, e.Err)
+}
+
+// Unwrap returns the error returned by the function computing the value of the variable.
+func (e *ErrVariable) Unwrap() error {
+	return e.Err
+}
+
+// ErrInvalidValue is returned by VarE when the value of a variable cannot be converted to a float64.
+type ErrInvalidValue struct {
+	// Var is the name of the variable.
+	Var string
+	// Value is the value that could not be converted.
+	Value interface{}
+	// Err is the error that occurred converting Value.
+	Err error
+}
+
+// Error implements error.
+func (e *ErrInvalidValue) Error() string {
+	return fmt.Sprintf("invalid value for var: %s (%T): %v", e.Var, e.Value, e.Err)
+}
+
+// Unwrap returns the error that occurred converting the value.
+func (e *ErrInvalidValue) Unwrap() error {
+	return e.Err
+}
+
+// ErrCanceled is returned when the context passed to EvalContext is canceled or its deadline is exceeded
+// before the evaluation of the formula is finished.
+type ErrCanceled struct {
+	// Pos is the character position in the formula where the evaluation was stopped.
+	Pos int
+	// Err is the error returned by the Err method of the context.
+	Err error
+}
+
+// Error implements error.
+func (e *ErrCanceled) Error() string {
+	return fmt.Sprintf("evaluation stopped (pos:%d): %v", e.Pos, e.Err)
+}
+
+// Unwrap returns the error returned by the Err method of the context.
+func (e *ErrCanceled) Unwrap() error {
+	return e.Err
+}
+
+// ErrFormulaTooLong is returned when a formula is longer than allowed using WithMaxLength.
+type ErrFormulaTooLong struct {
+	// Length is the length of the formula in bytes.
+	Length int
+	// Max is the maximum length of the formula in bytes.
+	Max int
+}
+
+// Error implements error.
+func (e *ErrFormulaTooLong) Error() string {
+	return fmt.Sprintf("formula too long: %d bytes (max:%d)", e.Length, e.Max)
+}
+
+// ErrTooDeep is returned when a formula is nested deeper than allowed using WithMaxDepth.
+type ErrTooDeep struct {
+	// Pos is the character position of the first expression found that is nested too deep.
+	Pos int
+	// Max is the maximum depth of the formula.
+	Max int
+}
+
+// Error implements error.
+func (e *ErrTooDeep) Error() string {
+	return fmt.Sprintf("formula too deep: exceeds depth %d (pos:%d)", e.Max, e.Pos)
+}
+
+// ErrTooManyNodes is returned when a formula has more nodes than allowed using WithMaxNodes.
+type ErrTooManyNodes struct {
+	// Pos is the character position of the first node found that exceeds the maximum.
+	Pos int
+	// Max is the maximum number of nodes in the formula.
+	Max int
+}
+
+// Error implements error.
+func (e *ErrTooManyNodes) Error() string {
+	return fmt.Sprintf("too many nodes: exceeds %d nodes (pos:%d)", e.Max, e.Pos)
+}
+
+// ErrOpBudgetExceeded is returned when an evaluation of a formula performs more operations than allowed using
+// WithMaxOps.
+type ErrOpBudgetExceeded struct {
+	// Pos is the character position of the operation that exceeded the budget.
+	Pos int
+	// Max is the maximum number of operations per evaluation.
+	Max int
+}
+
+// Error implements error.
+func (e *ErrOpBudgetExceeded) Error() string {
+	return fmt.Sprintf("operation budget exceeded: more than %d operations (pos:%d)", e.Max, e.Pos)
+}
+
+// ErrDivisionByZero is returned by formulas created using WithStrictMath when a value is divided by 0 or the
+// remainder of a division by 0 is taken.
+type ErrDivisionByZero struct {
+	// Pos is the character position of the / or % operator.
+	Pos int
+}
+
+// Error implements error.
+func (e *ErrDivisionByZero) Error() string {
+	return fmt.Sprintf("division by zero (pos:%d)", e.Pos)
+}
+
+// ErrDomain is returned by formulas created using WithStrictMath when a function or operator is passed a value
+// outside of its domain, such as in sqrt(-1) or acos(2), meaning its result is NaN.
+type ErrDomain struct {
+	// Func is the name of the function, or the operator, that was passed a value outside of its domain.
+	Func string
+	// Pos is the character position of Func.
+	Pos int
+}
+
+// Error implements error.
+func (e *ErrDomain) Error() string {
+	return fmt.Sprintf("domain error: %s (pos:%d)", e.Func, e.Pos)
+}
+
+// ErrNonFinite is returned by formulas created using WithStrictMath when a part of the formula results in an
+// infinite value or NaN, such as when a result overflows or a variable passed is NaN.
+type ErrNonFinite struct {
+	// Value is the value that is not finite.
+	Value float64
+	// Pos is the character position of the part of the formula that resulted in Value.
+	Pos int
+}
+
+// Error implements error.
+func (e *ErrNonFinite) Error() string {
+	return fmt.Sprintf("non-finite value: %v (pos:%d)", e.Value, e.Pos)
+}
+
+// ErrFunc is returned when a function registered using RegisterFuncE returns an error. It wraps the error
+// returned by the function.
+type ErrFunc struct {
+	// Func is the name of the function that returned the error.
+	Func string
+	// Pos is the character position of Func.
+	Pos int
+	// Err is the error returned by Func.
+	Err error
+}
+
+// Error implements error.
+func (e *ErrFunc) Error() string {
+	return fmt.Sprintf("error in func: %s (pos:%d): %v", e.Func, e.Pos, e.Err)
+}
+
+// Unwrap returns the error returned by the function.
+func (e *ErrFunc) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,187 @@
+package formula
+
+import (
+	"math"
+	"strconv"
+)
+
+// folder simplifies the AST of a formula before it is compiled. Sub-expressions that only consist of literals,
+// constants and calls to pure functions are computed once and replaced by their result, so that they are not
+// computed again on every evaluation. Identities such as x*1 and x+0 are simplified to x.
+//
+// The AST of the formula is never modified: Nodes that are simplified are copied instead.
+type folder struct {
+	defs *definitions
+	// constants holds the names of all constants that were folded into the AST. If a variable with one of these
+	// names is passed when evaluating the formula, the AST that was not folded must be used instead.
+	constants map[string]struct{}
+	// strict specifies if the formula is evaluated in strict math mode. If so, sub-expressions that result in
+	// an error in strict math mode are not folded, so that the error occurs when the formula is evaluated.
+	strict bool
+}
+
+// fold returns the simplified AST of the node passed, along with the names of the constants that were folded
+// into it. strict specifies if the formula is evaluated in strict math mode.
+func fold(root Node, defs *definitions, strict bool) (Node, map[string]struct{}) {
+	f := &folder{defs: defs, constants: make(map[string]struct{}), strict: strict}
+	return f.fold(root), f.constants
+}
+
+// fold simplifies the node passed and returns the resulting node, or n itself if it could not be simplified.
+func (f *folder) fold(n Node) Node {
+	switch n := n.(type) {
+	case *Ident:
+		if value, ok := f.defs.constants[n.Name]; ok {
+			f.constants[n.Name] = struct{}{}
+			return number(n.NamePos, value)
+		}
+	case *Unary:
+		x := f.fold(n.X)
+		if n.Op == OpAdd {
+			return x
+		}
+		if x != n.X {
+			n = &Unary{OpPos: n.OpPos, Op: n.Op, X: x}
+		}
+		if _, ok := x.(*Number); ok {
+			return f.evaluate(n)
+		}
+		return n
+	case *Binary:
+		return f.foldBinary(n)
+	case *Call:
+		return f.foldCall(n)
+	}
+	return n
+}
+
+// foldBinary simplifies a binary expression. If both operands are constant, the expression is computed. If one
+// of the operands makes the operation an identity, such as x*1 or x+0, the other operand is returned.
+func (f *folder) foldBinary(n *Binary) Node {
+	x, y := f.fold(n.X), f.fold(n.Y)
+	if x != n.X || y != n.Y {
+		n = &Binary{OpPos: n.OpPos, Op: n.Op, X: x, Y: y}
+	}
+	xNum, xConst := x.(*Number)
+	yNum, yConst := y.(*Number)
+	switch {
+	case xConst && yConst:
+		return f.evaluate(n)
+	case xConst && n.Op == OpLAnd && xNum.Value == 0:
+		// Y is never evaluated if X is false.
+		return number(n.OpPos, 0)
+	case xConst && n.Op == OpLOr && xNum.Value != 0 && !f.nonFinite(xNum):
+		// Y is never evaluated if X is true.
+		return number(n.OpPos, 1)
+	case xConst && isIdentity(n.Op, xNum.Value, false):
+		return y
+	case yConst && isIdentity(n.Op, yNum.Value, true):
+		return x
+	}
+	return n
+}
+
+// isIdentity checks if the value passed as operand of the operator passed makes the operation an identity,
+// meaning it results in the other operand. right specifies if the value is the right operand of the
+// operator.
+func isIdentity(op Op, value float64, right bool) bool {
+	switch op {
+	case OpAdd:
+		// Only -0 is an identity for addition, as -0 + 0 is 0.
+		return value == 0 && math.Signbit(value)
+	case OpMul:
+		return value == 1
+	case OpSub:
+		// Only 0 is an identity for subtraction, as -0 - -0 is 0.
+		return right && value == 0 && !math.Signbit(value)
+	case OpQuo, OpPow:
+		return right && value == 1
+	}
+	return false
+}
+
+// foldCall simplifies a call to a function. Calls to pure functions with only constant arguments are
+// computed. Calls to if and ifs with constant conditions are replaced by the value selected.
+func (f *folder) foldCall(n *Call) Node {
+	args := make([]Node, len(n.Args))
+	changed, constant := false, true
+	for i, arg := range n.Args {
+		args[i] = f.fold(arg)
+		if args[i] != arg {
+			changed = true
+		}
+		if _, ok := args[i].(*Number); !ok {
+			constant = false
+		}
+	}
+	if changed {
+		n = &Call{NamePos: n.NamePos, Name: n.Name, Args: args}
+	}
+
+	switch n.Name {
+	case "if", "ifs":
+		if checkConditional(n) != nil {
+			// Leave the error to be returned by the compiler.
+			return n
+		}
+		for i := 0; i < len(args)-1; i += 2 {
+			cond, ok := args[i].(*Number)
+			if !ok || f.nonFinite(cond) {
+				// Conditions that are not finite are left to fail when evaluated in strict math mode.
+				if i == 0 {
+					return n
+				}
+				// The conditions before this one are never met, so they may be dropped.
+				return &Call{NamePos: n.NamePos, Name: "ifs", Args: args[i:]}
+			}
+			if cond.Value != 0 {
+				return args[i+1]
+			}
+		}
+		return args[len(args)-1]
+	}
+	p := &astParser{functions: f.defs.functions}
+	if fn, err := p.function(n); err == nil && fn.pure && constant {
+		return f.evaluate(n)
+	}
+	return n
+}
+
+// nonFinite checks if the number passed is NaN or infinite in strict math mode, in which case it must be
+// evaluated, so that evaluating it fails.
+func (f *folder) nonFinite(n *Number) bool {
+	return f.strict && (math.IsNaN(n.Value) || math.IsInf(n.Value, 0))
+}
+
+// evaluate computes the value of the node passed, which must only consist of literals, and returns it as a
+// literal. If computing the value fails, for example because a function panicked, the node is returned so
+// that the error occurs when the formula is evaluated.
+func (f *folder) evaluate(n Node) Node {
+	p := &astParser{functions: f.defs.functions, strict: f.strict}
+	eval, err := p.parseExpr(n)
+	if err != nil {
+		return n
+	}
+	value, ok := func() (value float64, ok bool) {
+		defer func() {
+			if recover() != nil {
+				ok = false
+			}
+		}()
+		value, err := eval(&state{})
+		return value, err == nil
+	}()
+	if !ok {
+		return n
+	}
+	return number(n.Pos(), value)
+}
+
+// number returns a literal with the value passed at the position passed.
+func number(pos int, value float64) *Number {
+	literal := strconv.FormatFloat(value, 'g', -1, 64)
+	if math.IsNaN(value) {
+		literal = "nan"
+	}
+	return &Number{ValuePos: pos, Literal: literal, Value: value}
+}
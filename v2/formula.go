@@ -1,16 +1,87 @@
 package formula
 
 import (
+	"context"
 	"golang.org/x/xerrors"
 	"math"
+	"sync"
+	"sync/atomic"
 )
 
 // Formula is a parsed formula that is ready to be evaluated. It is safe to use concurrently from multiple
-// goroutines.
+// goroutines, including registering functions while the formula is being evaluated.
 type Formula struct {
-	parser *astParser
-	// evaluate is the function called when the formula is evaluated.
-	evaluate func(vars vars) (float64, error)
+	// root is the root node of the AST of the formula.
+	root Node
+	// env holds the *Environment with the functions and constants available to the formula. It is stored
+	// atomically, as a formula may replace its Environment while being evaluated.
+	env atomic.Value
+	// mu protects ownsEnv.
+	mu sync.Mutex
+	// ownsEnv is true if the Environment of the formula is owned by the formula, meaning functions may be
+	// registered to it without affecting other formulas.
+	ownsEnv bool
+	// program holds the *program that is run when the formula is evaluated.
+	program atomic.Value
+	// backend is the backend that the formula is compiled for.
+	backend Backend
+	// maxOps is the maximum number of operations performed by a single evaluation, or 0 if there is none.
+	maxOps int
+	// strict specifies if the formula is evaluated in strict math mode, as enabled using WithStrictMath.
+	strict bool
+
+	// slots maps the name of every identifier in the formula to the index of the slot that holds its value
+	// while evaluating.
+	slots map[string]int
+	// names holds the name of the identifier of every slot, indexed by slot.
+	names []string
+	// structs holds the []fieldSlot of every struct type passed to EvalStruct, indexed by its reflect.Type.
+	structs sync.Map
+
+	// functionNames holds the sorted names of all functions called in the formula.
+	functionNames []string
+}
+
+// program is a formula compiled against the definitions of an Environment. The functions called by the formula
+// are bound to the evaluator directly, so they need not be looked up while evaluating.
+type program struct {
+	// defs holds the definitions the program was compiled against.
+	defs *definitions
+	// root is the root of the folded AST of the formula.
+	root Node
+	// evaluate is the function called when the formula is evaluated. It evaluates the folded AST of the formula.
+	evaluate evaluator
+	// values and known hold the initial values of the slots of the formula: The values of the constants
+	// used in the formula, which may be over-ridden by variables.
+	values []float64
+	known  []bool
+	// folded specifies for every slot if it holds a constant folded into evaluate. If one of these is
+	// over-ridden by a variable, the formula is evaluated using exact instead.
+	folded []bool
+	// exactOnce and exact hold a function that evaluates the AST of the formula without folding constants. It
+	// is only compiled once it is needed.
+	exactOnce sync.Once
+	exact     evaluator
+	// batchOnce, batch, exactBatchOnce and exactBatch hold the functions that evaluate the folded AST and the
+	// AST without folded constants over columns of values. They are only compiled once EvalBatch is called.
+	batchOnce, exactBatchOnce sync.Once
+	batch, exactBatch         batchEvaluator
+}
+
+// defaultConstants holds the special math constants that are available in every formula, unless over-ridden
+// by variables or disabled using WithoutDefaults.
+var defaultConstants = map[string]float64{
+	"π":  math.Pi,
+	"𝜋":  math.Pi,
+	"pi": math.Pi,
+
+	"Φ":   math.Phi,
+	"phi": math.Phi,
+
+	"e": math.E,
+	"E": math.E,
+
+	"nan": math.NaN(),
 }
 
 // New returns a new formula for a given string. The formula is parsed and may be evaluated if parsed
@@ -19,13 +90,102 @@ type Formula struct {
 // Most functions from the math package that return a single float64 are supported. The equivalent function
 // name is all lower-cased. Therefore RoundToEven becomes roundtoeven. See https://golang.org/pkg/math/.
 func New(formula string) (*Formula, error) {
-	p := &astParser{formula: formula, functions: make(map[string]availableFunc)}
-	eval, err := p.parse()
+	return NewWithOptions(formula)
+}
+
+// NewWithOptions returns a new formula for a given string, like New, with the options passed applied to it.
+//
+// Example:
+//
+//  f, err := formula.NewWithOptions("clamp(x, 0, 1) * scale",
+//     formula.WithFuncRange("clamp", 3, 3, clamp),
+//     formula.WithConstants(map[string]float64{"scale": 100}),
+//     formula.WithValidation(),
+//  )
+//
+func NewWithOptions(formula string, opts ...Option) (*Formula, error) {
+	o := options{defaults: true}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	env := o.env
+	if env == nil {
+		env = defaultEnvironment
+		if !o.defaults {
+			env = emptyEnvironment
+		}
+	}
+	if o.maxLength > 0 && len(formula) > o.maxLength {
+		return nil, &ErrFormulaTooLong{Length: len(formula), Max: o.maxLength}
+	}
+	p := &astParser{formula: formula, limits: o.limits}
+	root, err := p.parse()
+	if err != nil {
+		return nil, xerrors.Errorf("error parsing formula: %w", err)
+	}
+	// Operators of the same precedence, such as in 1+2+3, are parsed without nesting, so the AST may still be
+	// deeper than the nesting checked while parsing.
+	if n := tooDeep(root, o.depth()); n != nil {
+		return nil, xerrors.Errorf("error parsing formula: %w", &ErrTooDeep{Pos: n.Pos(), Max: o.depth()})
+	}
+
+	// Check the built-in conditionals before compiling, as calls in branches that are never selected are
+	// removed when the formula is folded.
+	Inspect(root, func(n Node) bool {
+		if call, ok := n.(*Call); ok && err == nil {
+			err = checkConditional(call)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("error parsing formula: %w", err)
+	}
+
+	idents, calls := make(map[string]struct{}), make(map[string]struct{})
+	Inspect(root, func(n Node) bool {
+		switch n := n.(type) {
+		case *Ident:
+			idents[n.Name] = struct{}{}
+		case *Call:
+			if n.Name != "if" && n.Name != "ifs" {
+				calls[n.Name] = struct{}{}
+			}
+		}
+		return true
+	})
+
+	f := &Formula{root: root, backend: o.backend, maxOps: o.maxOps, strict: o.strict, slots: make(map[string]int, len(idents)), names: sortedKeys(idents, nil)}
+	for i, name := range f.names {
+		f.slots[name] = i
+	}
+	f.env.Store(env)
+	if len(o.constants) != 0 || len(o.functions) != 0 {
+		env = f.ownEnvironment()
+		for name, value := range o.constants {
+			env.SetConstant(name, value)
+		}
+		for _, fn := range o.functions {
+			env.register(fn.name, fn.availableFunc)
+		}
+	}
+
+	prog, err := f.compile(env.definitions())
 	if err != nil {
 		return nil, xerrors.Errorf("error parsing formula: %w", err)
 	}
-	f := &Formula{evaluate: eval, parser: p}
-	f.registerDefaults()
+	f.program.Store(prog)
+
+	f.functionNames = sortedKeys(calls, nil)
+
+	if o.validate {
+		if err := f.Validate(); err != nil {
+			return nil, xerrors.Errorf("error validating formula: %w", err)
+		}
+	}
 	return f, nil
 }
 
@@ -33,6 +193,7 @@ func New(formula string) (*Formula, error) {
 // floats and one output float. The paramCount passed indicates the number of input floats expected. If less than the
 // required paramCount arguments are passed to the function, Eval will return an ErrInsufficientArgs error. The function
 // does not need to internally check the correct arg length. Functions must be registered with the formula before evaluating.
+// Functions registered are only available in this formula, even if it was created with a shared Environment.
 //
 // Example:
 //
@@ -45,35 +206,311 @@ func New(formula string) (*Formula, error) {
 //  })
 //
 func (formula *Formula) RegisterFunc(name string, paramCount int, f func(args ...float64) float64) {
-	formula.parser.functions[name] = availableFunc{function: f, paramCount: paramCount}
+	formula.RegisterFuncRange(name, paramCount, Variadic, f)
+}
+
+// Variadic may be passed as maxParamCount to RegisterFuncRange to indicate a function accepts an unlimited
+// number of arguments.
+const Variadic = -1
+
+// RegisterFuncRange registers a custom function like RegisterFunc, but additionally limits the number of
+// arguments that may be passed to it to maxParamCount. If more arguments are passed, Eval will return an
+// ErrTooManyArgs error. Variadic may be passed as maxParamCount to allow any number of arguments.
+//
+// Example:
+//
+//  // Add clamp function, which requires exactly 3 arguments.
+//  RegisterFuncRange("clamp", 3, 3, func(args ...float64) float64 {
+//     return math.Max(args[1], math.Min(args[0], args[2]))
+//  })
+//
+func (formula *Formula) RegisterFuncRange(name string, paramCount, maxParamCount int, f func(args ...float64) float64) {
+	formula.ownEnvironment().RegisterFuncRange(name, paramCount, maxParamCount, f)
+}
+
+// RegisterFuncContext registers a custom function like RegisterFuncRange, but the function receives the
+// context passed to EvalContext, or context.Background() if the formula is evaluated using Eval. It may be used
+// for functions that call other services, so that these calls may be canceled.
+//
+// Example:
+//
+//  RegisterFuncContext("price", 1, 1, func(ctx context.Context, args ...float64) float64 {
+//     price, _ := prices.Lookup(ctx, int(args[0]))
+//     return price
+//  })
+//
+func (formula *Formula) RegisterFuncContext(name string, paramCount, maxParamCount int, f func(ctx context.Context, args ...float64) float64) {
+	formula.ownEnvironment().RegisterFuncContext(name, paramCount, maxParamCount, f)
+}
+
+// RegisterFuncE registers a custom function like RegisterFuncRange, but the function may return an error. If
+// it does, the evaluation of the formula is stopped and the error is returned wrapped in an ErrFunc, which
+// holds the name and position of the function called. The error may be retrieved using errors.Is and
+// errors.As, or their equivalents in golang.org/x/xerrors.
+//
+// Example:
+//
+//  RegisterFuncE("rate", 1, 1, func(args ...float64) (float64, error) {
+//     rate, ok := rates[int(args[0])]
+//     if !ok {
+//        return 0, ErrNoRate
+//     }
+//     return rate, nil
+//  })
+//
+func (formula *Formula) RegisterFuncE(name string, paramCount, maxParamCount int, f func(args ...float64) (float64, error)) {
+	formula.ownEnvironment().RegisterFuncE(name, paramCount, maxParamCount, f)
+}
+
+// RegisterGoFunc registers a Go function with numeric or bool parameters and result in the formula, so that
+// no func(args ...float64) float64 adapter needs to be written for it. The number of arguments accepted is
+// inferred from the parameters: Variadic functions accept any number of arguments after their fixed
+// parameters. Arguments passed to integer parameters are truncated towards zero, bool parameters are true
+// for any value other than 0 and time.Duration parameters and results are in seconds. If an argument passed
+// to an unsigned integer parameter is negative after truncating or NaN, the function is not called and
+// ErrFunc is returned. The function may additionally:
+//
+//  - accept a context.Context as first parameter, which receives the context passed to EvalContext.
+//  - return an error after its result, which is returned as ErrFunc, like functions registered using
+//    RegisterFuncE.
+//
+// An error is returned if fn is not a func with such a signature.
+//
+// Example:
+//
+//  f.RegisterGoFunc("pow", math.Pow)
+//  f.RegisterGoFunc("yn", math.Yn)
+//  f.RegisterGoFunc("price", func(ctx context.Context, id int, quantity uint) (float64, error) {
+//     return prices.Lookup(ctx, id, quantity)
+//  })
+//
+func (formula *Formula) RegisterGoFunc(name string, fn interface{}) error {
+	f, err := goFunc(fn)
+	if err != nil {
+		return xerrors.Errorf("cannot register func %v: %w", name, err)
+	}
+	formula.ownEnvironment().register(name, f)
+	return nil
+}
+
+// Describe sets the description and parameter names of the custom function with the name passed, like
+// Environment.Describe, but only affects this formula. They are returned by Environment().Functions(), so that
+// they may be shown to users writing formulas.
+func (formula *Formula) Describe(name, description string, params ...string) {
+	formula.ownEnvironment().Describe(name, description, params...)
+}
+
+// SetPure marks the custom function with the name passed as pure or impure, like Environment.SetPure, but only
+// affects this formula. Calls to pure functions with constant arguments are computed once when the formula is
+// compiled, so a function must only be marked pure if it always returns the same result for the same
+// arguments and has no side effects.
+//
+// Example:
+//
+//  RegisterFunc("square", 1, func(args ...float64) float64 {
+//     return args[0] * args[0]
+//  })
+//  // square(3) is now computed once instead of on every evaluation.
+//  SetPure("square", true)
+//
+func (formula *Formula) SetPure(name string, pure bool) {
+	formula.ownEnvironment().SetPure(name, pure)
+}
+
+// ownEnvironment returns an Environment owned by the formula that functions may be registered to, by
+// extending the Environment it was created with if it has not done so yet.
+func (formula *Formula) ownEnvironment() *Environment {
+	formula.mu.Lock()
+	defer formula.mu.Unlock()
+	if !formula.ownsEnv {
+		formula.env.Store(formula.Environment().Extend())
+		formula.ownsEnv = true
+	}
+	return formula.Environment()
+}
+
+// Environment returns the Environment holding the functions and constants available in the formula.
+func (formula *Formula) Environment() *Environment {
+	return formula.env.Load().(*Environment)
+}
+
+// compile compiles the formula for its backend against the definitions passed, binding every function called
+// to the evaluator returned. Constant parts of the formula are folded before compiling.
+func (formula *Formula) compile(defs *definitions) (*program, error) {
+	root, folded := fold(formula.root, defs, formula.strict)
+	eval, err := formula.compileRoot(root, defs)
+	if err != nil {
+		return nil, err
+	}
+	prog := &program{
+		root:     root,
+		defs:     defs,
+		evaluate: eval,
+		values:   make([]float64, len(formula.slots)),
+		known:    make([]bool, len(formula.slots)),
+		folded:   make([]bool, len(formula.slots)),
+	}
+	for name, slot := range formula.slots {
+		prog.values[slot], prog.known[slot] = defs.constants[name]
+		_, prog.folded[slot] = folded[name]
+	}
+	if len(folded) == 0 {
+		prog.exact = eval
+		prog.exactOnce.Do(func() {})
+	}
+	return prog, nil
+}
+
+// compileRoot compiles the AST with the root passed for the backend of the formula.
+func (formula *Formula) compileRoot(root Node, defs *definitions) (evaluator, error) {
+	if formula.backend == BackendVM {
+		return compileVM(root, formula.parser(defs))
+	}
+	return formula.parser(defs).parseExpr(root)
+}
+
+// parser returns an astParser that compiles the formula against the definitions passed.
+func (formula *Formula) parser(defs *definitions) *astParser {
+	return &astParser{
+		functions: defs.functions,
+		slots:     formula.slots,
+		limits:    limits{maxOps: formula.maxOps},
+		strict:    formula.strict,
+	}
+}
+
+// exact returns the function that evaluates the program without folding constants. It is used if a constant
+// that was folded is over-ridden by a variable.
+func (formula *Formula) exact(prog *program) evaluator {
+	prog.exactOnce.Do(func() {
+		// The folded AST was compiled successfully, so compiling the AST itself cannot fail.
+		prog.exact, _ = formula.compileRoot(formula.root, prog.defs)
+	})
+	return prog.exact
+}
+
+// compiled returns the program of the formula compiled against the current definitions of its Environment.
+// If functions or constants were added to the Environment since the formula was last compiled, the formula is
+// compiled again, so that these functions are bound.
+func (formula *Formula) compiled() *program {
+	prog := formula.program.Load().(*program)
+	if defs := formula.Environment().definitions(); prog.defs != defs {
+		var err error
+		if prog, err = formula.compile(defs); err != nil {
+			// The AST was compiled successfully before, so compiling it again cannot fail.
+			panic(err)
+		}
+		formula.program.Store(prog)
+	}
+	return prog
+}
+
+// Validate checks if all functions called in the formula have been registered and are passed a valid number
+// of arguments. Without validating, these errors are only returned when the formula is evaluated. The
+// first ErrUnknownFunc, ErrInsufficientArgs or ErrTooManyArgs found is returned. Validate should be called
+// after registering all custom functions used.
+func (formula *Formula) Validate() error {
+	p := &astParser{functions: formula.Environment().definitions().functions}
+	var err error
+	Inspect(formula.root, func(n Node) bool {
+		call, ok := n.(*Call)
+		if err != nil || !ok || call.Name == "if" || call.Name == "ifs" {
+			return err == nil
+		}
+		_, err = p.function(call)
+		return err == nil
+	})
+	return err
 }
 
 // Eval evaluates a formula using the variables passed. If an unknown variable/constant or function is encountered,
-// ErrUnknownVariable or ErrUnknownFunc is returned respectively. If a known function is passed with too few arguments,
-// ErrInsufficientArgs is returned.
+// ErrUnknownVariable or ErrUnknownFunc is returned respectively. If a known function is passed with too few or too many
+// arguments, ErrInsufficientArgs or ErrTooManyArgs is returned respectively.
 //
 // Some special math constants are already included. They are automatically defined unless over-ridden
-// by variables. These are: π, 𝜋, pi, Φ, phi, e, E.
+// by variables or disabled using WithoutDefaults. These are: π, 𝜋, pi, Φ, phi, e, E and nan. More constants
+// may be added using WithConstants.
 func (formula *Formula) Eval(variables ...Variable) (float64, error) {
-	// Add special constants
-	variableMap := vars{
-		"π":  math.Pi,
-		"𝜋":  math.Pi,
-		"pi": math.Pi,
+	return formula.eval(nil, variables)
+}
 
-		"Φ":   math.Phi,
-		"phi": math.Phi,
+// EvalContext evaluates the formula using the variables passed, like Eval, but stops evaluating once the
+// context passed is canceled or its deadline is exceeded. The context is checked before evaluating the formula
+// and before every call to a function and computation of a lazy variable, which are the only parts of a
+// formula that may take long to evaluate. If the evaluation was stopped, ErrCanceled is returned with the
+// position in the formula where it was stopped, wrapping ctx.Err().
+//
+// Functions registered using RegisterFuncContext receive the context passed.
+func (formula *Formula) EvalContext(ctx context.Context, variables ...Variable) (float64, error) {
+	if err := ctx.Err(); err != nil {
+		return math.NaN(), &ErrCanceled{Pos: 0, Err: err}
+	}
+	return formula.eval(ctx, variables)
+}
 
-		"e": math.E,
-		"E": math.E,
+// eval evaluates the formula using the variables passed. If ctx is not nil, the evaluation is stopped once it
+// is canceled.
+func (formula *Formula) eval(ctx context.Context, variables []Variable) (float64, error) {
+	prog := formula.compiled()
+	s := newState(prog)
+	if ctx != nil {
+		s.ctx, s.done = ctx, ctx.Done()
+	}
+	for _, variable := range variables {
+		if slot, ok := formula.slots[variable.name]; ok {
+			s.set(slot, variable)
+		}
+	}
+	return formula.run(prog, s)
+}
 
-		"nan": math.NaN(),
+// run evaluates the program passed using the state passed, which must have been obtained using newState for
+// the program. If a constant folded into the program was over-ridden, the AST without folded constants is
+// evaluated instead.
+func (formula *Formula) run(prog *program, s *state) (float64, error) {
+	if s.exact {
+		return s.run(formula.exact(prog))
 	}
+	return s.run(prog.evaluate)
+}
 
-	for _, variable := range variables {
-		variableMap[variable.name] = variable.value
+// AST returns the root node of the AST of the formula. It may be used to inspect the structure of the
+// formula, for example using Inspect. The nodes returned must not be modified.
+func (formula *Formula) AST() Node {
+	return formula.root
+}
+
+// Variables returns the sorted names of all variables used in the formula. These are the variables that must be
+// passed to Eval. Special math constants, such as π and e, are not included: these are returned by Constants.
+// Whether a name is a constant depends on the current constants of the Environment of the formula.
+func (formula *Formula) Variables() []string {
+	return formula.identNames(false)
+}
+
+// Constants returns the sorted names of all constants, such as π and e, used in the formula. Like Variables,
+// it reflects the current constants of the Environment of the formula.
+func (formula *Formula) Constants() []string {
+	return formula.identNames(true)
+}
+
+// identNames returns the sorted names of the identifiers in the formula that are constants if constants is
+// true, or variables if it is false.
+func (formula *Formula) identNames(constants bool) []string {
+	prog := formula.compiled()
+	names := make([]string, 0, len(formula.names))
+	for slot, name := range formula.names {
+		if prog.known[slot] == constants {
+			names = append(names, name)
+		}
 	}
-	return formula.evaluate(variableMap)
+	return names
+}
+
+// Functions returns the sorted names of all functions called in the formula. The built-in conditionals if
+// and ifs are not included. Information about all functions that are available in the formula, such as their
+// parameters, is returned by Environment().Functions().
+func (formula *Formula) Functions() []string {
+	return append([]string(nil), formula.functionNames...)
 }
 
 // MustEval calls Eval but panics if Eval returns an error.
@@ -84,60 +521,3 @@ func (formula *Formula) MustEval(variables ...Variable) float64 {
 	}
 	return f
 }
-
-// registerDefaults registers all functions found in the functions.go file to the formula. This is done for
-// each formula automatically, so these functions do not need to be added manually.
-func (formula *Formula) registerDefaults() {
-	formula.RegisterFunc("abs", 1, abs)
-	formula.RegisterFunc("acos", 1, acos)
-	formula.RegisterFunc("acosh", 1, acosh)
-	formula.RegisterFunc("asin", 1, asin)
-	formula.RegisterFunc("asinh", 1, asinh)
-	formula.RegisterFunc("atan", 1, atan)
-	formula.RegisterFunc("atan2", 2, atan2)
-	formula.RegisterFunc("atanh", 1, atanh)
-	formula.RegisterFunc("cbrt", 1, cbrt)
-	formula.RegisterFunc("ceil", 1, ceil)
-	formula.RegisterFunc("copysign", 2, copysign)
-	formula.RegisterFunc("cos", 1, cos)
-	formula.RegisterFunc("cosh", 1, cosh)
-	formula.RegisterFunc("dim", 2, dim)
-	formula.RegisterFunc("erf", 1, erf)
-	formula.RegisterFunc("erfc", 1, erfc)
-	formula.RegisterFunc("erfcinv", 1, erfcinv)
-	formula.RegisterFunc("erfinv", 1, erfinv)
-	formula.RegisterFunc("exp", 1, exp)
-	formula.RegisterFunc("exp2", 1, exp2)
-	formula.RegisterFunc("expm1", 1, expm1)
-	formula.RegisterFunc("floor", 1, floor)
-	formula.RegisterFunc("gamma", 1, gamma)
-	formula.RegisterFunc("hypot", 2, hypot)
-	formula.RegisterFunc("j0", 1, j0)
-	formula.RegisterFunc("j1", 1, j1)
-	formula.RegisterFunc("jn", 2, jn)
-	formula.RegisterFunc("log", 1, log)
-	formula.RegisterFunc("log10", 1, log10)
-	formula.RegisterFunc("log1p", 1, log1p)
-	formula.RegisterFunc("log2", 1, log2)
-	formula.RegisterFunc("logb", 1, logb)
-	formula.RegisterFunc("max", 1, max)
-	formula.RegisterFunc("min", 1, min)
-	formula.RegisterFunc("mod", 2, mod)
-	formula.RegisterFunc("nextafter", 2, nextafter)
-	formula.RegisterFunc("pow", 2, pow)
-	formula.RegisterFunc("pow10", 1, pow10)
-	formula.RegisterFunc("remainder", 2, remainder)
-	formula.RegisterFunc("round", 1, round)
-	formula.RegisterFunc("roundtoeven", 1, roundtoeven)
-	formula.RegisterFunc("sin", 1, sin)
-	formula.RegisterFunc("sinh", 1, sinh)
-	formula.RegisterFunc("sqrt", 1, sqrt)
-	formula.RegisterFunc("tan", 1, tan)
-	formula.RegisterFunc("tanh", 1, tanh)
-	formula.RegisterFunc("trunc", 1, trunc)
-	formula.RegisterFunc("y0", 1, y0)
-	formula.RegisterFunc("y1", 1, y1)
-	formula.RegisterFunc("yn", 1, yn)
-
-	formula.registerExtra()
-}
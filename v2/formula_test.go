@@ -1,8 +1,19 @@
 package formula
 
 import (
+	"context"
+	"encoding/json"
 	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
 )
 
 func TestFormula_Eval(t *testing.T) {
@@ -46,3 +57,1380 @@ func TestMinMax(t *testing.T) {
 		return
 	}
 }
+
+func TestUnary(t *testing.T) {
+	formula, err := New("-x + +3 - -(2*x) + !x + !0 + ^2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual := formula.MustEval(Var("x", 4))
+	expected := -4.0 + 3.0 + 2.0*4.0 + 0.0 + 1.0 - 3.0
+	if expected != actual {
+		t.Errorf("expected formula result and Go result to be equal: expected: %v, actual: %v", expected, actual)
+		return
+	}
+	if _, err := New("&x"); err == nil {
+		t.Error("expected error parsing unknown unary operator &")
+	}
+}
+
+func TestComparisonLogical(t *testing.T) {
+	formula, err := New("(x > 3 && y <= 2) + (x == 4) + (x != 4) + (x < 4 || y >= 2) + (x >= 5 && unknown > 0)")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual := formula.MustEval(Var("x", 4), Var("y", 2))
+	expected := 3.0
+	if expected != actual {
+		t.Errorf("expected formula result and Go result to be equal: expected: %v, actual: %v", expected, actual)
+		return
+	}
+}
+
+func TestConditional(t *testing.T) {
+	formula, err := New("if(x == 0, 0, y/x) + ifs(x > 10, unknown, x > 2, 10, 1)")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// The unknown variable in the branch not selected must not result in an error.
+	actual := formula.MustEval(Var("x", 4), Var("y", 2))
+	expected := 10.5
+	if expected != actual {
+		t.Errorf("expected formula result and Go result to be equal: expected: %v, actual: %v", expected, actual)
+		return
+	}
+	if _, err := formula.Eval(Var("x", 0)); err != nil {
+		t.Errorf("expected no error for branch not selected: %v", err)
+	}
+	if _, err := New("if(x, 1)"); err == nil {
+		t.Error("expected error for if with 2 arguments")
+	}
+}
+
+func TestExponent(t *testing.T) {
+	formula, err := New("-x^2 + 2**3**2 + 2^-1 + 3*x**2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual := formula.MustEval(Var("x", 3))
+	expected := -9.0 + 512.0 + 0.5 + 27.0
+	if expected != actual {
+		t.Errorf("expected formula result and Go result to be equal: expected: %v, actual: %v", expected, actual)
+		return
+	}
+}
+
+func TestGrammar(t *testing.T) {
+	formula, err := New("2x + 3(x+1) + 4! + order.total * .5 + 1.5e2")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual := formula.MustEval(Var("x", 2), Var("order.total", 10))
+	expected := 4.0 + 9.0 + 24.0 + 5.0 + 150.0
+	if expected != actual {
+		t.Errorf("expected formula result and Go result to be equal: expected: %v, actual: %v", expected, actual)
+		return
+	}
+	for _, invalid := range []string{"", "1 +", "(1", "x y", "1 = 2", "**2", "'a'", "max(1,)", "max(,1)"} {
+		if _, err := New(invalid); err == nil {
+			t.Errorf("expected error parsing invalid formula %q", invalid)
+		}
+	}
+}
+
+func TestFormula_AST(t *testing.T) {
+	formula, err := New("-x + pow(y, 2) * 3")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	root, ok := formula.AST().(*Binary)
+	if !ok || root.Op != OpAdd || root.Pos() != 3 {
+		t.Errorf("expected root to be a + binary expression at pos 3, got %#v", formula.AST())
+		return
+	}
+	var idents []string
+	calls := 0
+	Inspect(root, func(n Node) bool {
+		switch n := n.(type) {
+		case *Ident:
+			idents = append(idents, n.Name)
+		case *Call:
+			calls++
+		}
+		return true
+	})
+	if len(idents) != 2 || idents[0] != "x" || idents[1] != "y" || calls != 1 {
+		t.Errorf("expected identifiers [x y] and 1 call, got %v and %v calls", idents, calls)
+	}
+}
+
+func TestFormula_Variables(t *testing.T) {
+	formula, err := New("if(y > 0, pow(x, 2), sqrt(y)) * π + x * e + pow(z, 2)")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if actual := formula.Variables(); !reflect.DeepEqual(actual, []string{"x", "y", "z"}) {
+		t.Errorf("expected variables [x y z], got %v", actual)
+	}
+	if actual := formula.Constants(); !reflect.DeepEqual(actual, []string{"e", "π"}) {
+		t.Errorf("expected constants [e π], got %v", actual)
+	}
+	if actual := formula.Functions(); !reflect.DeepEqual(actual, []string{"pow", "sqrt"}) {
+		t.Errorf("expected functions [pow sqrt], got %v", actual)
+	}
+}
+
+func TestFormula_Validate(t *testing.T) {
+	formula, err := New("sin(x) + sqr(x)")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err, ok := formula.Validate().(*ErrUnknownFunc); !ok || err.Func != "sqr" || err.Pos != 9 {
+		t.Errorf("expected ErrUnknownFunc for sqr at pos 9, got %v", err)
+	}
+	formula.RegisterFuncRange("sqr", 1, 1, func(args ...float64) float64 {
+		return args[0] * args[0]
+	})
+	if err := formula.Validate(); err != nil {
+		t.Errorf("expected formula to be valid after registering sqr: %v", err)
+	}
+
+	formula, err = New("sin(1, 2, 3)")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, ok := formula.Validate().(*ErrTooManyArgs); !ok {
+		t.Errorf("expected ErrTooManyArgs validating sin(1, 2, 3), got %v", formula.Validate())
+	}
+	if _, err := formula.Eval(); err == nil {
+		t.Error("expected error evaluating sin(1, 2, 3)")
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	clamp := func(args ...float64) float64 {
+		return math.Max(args[1], math.Min(args[0], args[2]))
+	}
+	formula, err := NewWithOptions("clamp(x, 0, 1) * scale",
+		WithFuncRange("clamp", 3, 3, clamp),
+		WithConstants(map[string]float64{"scale": 100}),
+		WithValidation(),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	actual := formula.MustEval(Var("x", 0.5))
+	expected := 50.0
+	if expected != actual {
+		t.Errorf("expected formula result and Go result to be equal: expected: %v, actual: %v", expected, actual)
+	}
+	if actual := formula.Variables(); !reflect.DeepEqual(actual, []string{"x"}) {
+		t.Errorf("expected variables [x], got %v", actual)
+	}
+
+	if _, err := NewWithOptions("sin(π)", WithoutDefaults(), WithValidation()); err == nil {
+		t.Error("expected validation error for sin without default functions")
+	}
+	if _, err := NewWithOptions("((1 + 2) * 3) / 4", WithMaxDepth(3)); err == nil {
+		t.Error("expected error for formula exceeding maximum depth")
+	}
+	if _, err := NewWithOptions("(1 + 2) * 3", WithMaxDepth(3)); err != nil {
+		t.Errorf("expected no error for formula within maximum depth: %v", err)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	env := NewEnvironment()
+	env.RegisterFuncRange("double", 1, 1, func(args ...float64) float64 {
+		return args[0] * 2
+	})
+	env.SetConstant("answer", 42)
+	env.Freeze()
+
+	a, err := NewWithOptions("double(answer)", WithEnvironment(env))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	b, err := NewWithOptions("double(x) + triple(x)", WithEnvironment(env))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// Registering a function to one formula must not affect the environment or other formulas.
+	b.RegisterFunc("triple", 1, func(args ...float64) float64 {
+		return args[0] * 3
+	})
+	if actual := a.MustEval(); actual != 84 {
+		t.Errorf("expected 84, got %v", actual)
+	}
+	if actual := b.MustEval(Var("x", 1)); actual != 5 {
+		t.Errorf("expected 5, got %v", actual)
+	}
+	if _, ok := env.definitions().functions["triple"]; ok {
+		t.Error("expected function registered to formula not to be added to the shared environment")
+	}
+
+	extended := env.Extend()
+	extended.SetConstant("answer", 43)
+	if env.definitions().constants["answer"] != 42 || extended.definitions().constants["answer"] != 43 {
+		t.Error("expected extending an environment to copy its constants on write")
+	}
+
+	// Constants added to the Environment after creating a formula are no longer variables of the formula.
+	shared := NewEnvironment()
+	c, err := NewWithOptions("rate * x", WithEnvironment(shared))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if actual := c.Variables(); !reflect.DeepEqual(actual, []string{"rate", "x"}) {
+		t.Errorf("expected variables [rate x], got %v", actual)
+	}
+	shared.SetConstant("rate", 2)
+	if actual := c.Variables(); !reflect.DeepEqual(actual, []string{"x"}) {
+		t.Errorf("expected variables [x], got %v", actual)
+	}
+	if actual := c.Constants(); !reflect.DeepEqual(actual, []string{"rate"}) {
+		t.Errorf("expected constants [rate], got %v", actual)
+	}
+}
+
+func TestConcurrentRegisterFunc(t *testing.T) {
+	env := NewEnvironment()
+	formula, err := NewWithOptions("double(x) + triple(x)", WithEnvironment(env))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	formula.RegisterFunc("double", 1, func(args ...float64) float64 {
+		return args[0] * 2
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				// triple may or may not be registered yet, so an error is expected until it is.
+				if v, err := formula.Eval(Var("x", 1)); err == nil && v != 5 {
+					t.Errorf("expected 5, got %v", v)
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			formula.RegisterFunc("triple", 1, func(args ...float64) float64 {
+				return args[0] * 3
+			})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			env.SetConstant("c", float64(j))
+			env.RegisterFunc("unused", 0, func(args ...float64) float64 {
+				return 0
+			})
+		}
+	}()
+	wg.Wait()
+
+	if actual := formula.MustEval(Var("x", 1)); actual != 5 {
+		t.Errorf("expected 5, got %v", actual)
+	}
+}
+
+func BenchmarkFormula_Eval(b *testing.B) {
+	formula, err := New("(1 * 2 / 3 + 4 - 5 * (21*z+pow(x*3, 3))) + max(x, z, 3) + sqrt(abs(x - z))")
+	if err != nil {
+		b.Fatal(err)
+	}
+	x, z := Var("x", 4.5), Var("z", 5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = formula.Eval(x, z)
+	}
+}
+
+func BenchmarkFormula_EvalParallel(b *testing.B) {
+	formula, err := New("(1 * 2 / 3 + 4 - 5 * (21*z+pow(x*3, 3))) + max(x, z, 3) + sqrt(abs(x - z))")
+	if err != nil {
+		b.Fatal(err)
+	}
+	x, z := Var("x", 4.5), Var("z", 5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, _ = formula.Eval(x, z)
+		}
+	})
+}
+
+func BenchmarkFormula_EvalCalls(b *testing.B) {
+	formula, err := New("sin(x) + cos(x) + pow(x, 2) + sqrt(abs(x)) + max(x, 1, 2) + min(x, 1, 2) + hypot(x, 3)")
+	if err != nil {
+		b.Fatal(err)
+	}
+	x := Var("x", 4.5)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = formula.Eval(x)
+	}
+}
+
+func TestRebindFunctions(t *testing.T) {
+	env := NewEnvironment()
+	formula, err := NewWithOptions("1 + later(x) + crash(x)", WithEnvironment(env))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := formula.Eval(Var("x", 1)); err == nil {
+		t.Error("expected error evaluating formula with unknown function")
+	}
+	env.RegisterFunc("later", 1, func(args ...float64) float64 {
+		return args[0] * 10
+	})
+	formula.RegisterFunc("crash", 1, func(args ...float64) float64 {
+		return args[5]
+	})
+	if _, err := formula.Eval(Var("x", 1)); err == nil {
+		t.Error("expected panic in crash to be returned as error")
+	} else if err, ok := err.(*ErrPanic); !ok || err.Func != "crash" || err.Pos != 15 {
+		t.Errorf("expected ErrPanic for crash at pos 15, got %v", err)
+	}
+	formula.RegisterFunc("crash", 1, func(args ...float64) float64 {
+		return 0
+	})
+	if actual := formula.MustEval(Var("x", 1)); actual != 11 {
+		t.Errorf("expected 11, got %v", actual)
+	}
+}
+
+func TestBackendVM(t *testing.T) {
+	formulas := []string{
+		"(1 * 2 / 3 + 4 - 5 * (21*z+pow(x*3, 3))) + max(x, z, 3) + sqrt(abs(x - z))",
+		"-x^2 + 2x - ^3 + !x + 3! + 7 % 4",
+		"x > 2 && z < 10 || !(x == z) && x != 3 <= 4",
+		"0 && unknown || 1 || unknown",
+		"if(x > z, unknown, max(x, if(z, 1, 2)))",
+		"ifs(x > 10, unknown, x > 2, 10, 1)",
+		"unknown + 1",
+		"sin(x) + nofunc(x, 1)",
+		"pow(x) * 2",
+		"sqrt(x, z) + pi",
+		"max(min(x, z, hypot(x, 3), 4), pow(2, x), 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17)",
+	}
+	for _, f := range formulas {
+		closure, err := New(f)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		vm, err := NewWithOptions(f, WithBackend(BackendVM))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, x := range []float64{0, 1, 4.5, 11} {
+			vars := []Variable{Var("x", x), Var("z", 5)}
+			expected, expectedErr := closure.Eval(vars...)
+			actual, err := vm.Eval(vars...)
+			if !reflect.DeepEqual(err, expectedErr) {
+				t.Errorf("%v: expected error %v from VM, got %v", f, expectedErr, err)
+			}
+			if actual != expected && !(math.IsNaN(actual) && math.IsNaN(expected)) {
+				t.Errorf("%v: expected %v from VM, got %v", f, expected, actual)
+			}
+		}
+	}
+
+	if _, err := NewWithOptions("ifs(x, 1)", WithBackend(BackendVM)); err == nil {
+		t.Error("expected error creating formula with invalid ifs")
+	}
+	vm, err := NewWithOptions("1 + crash(x)", WithBackend(BackendVM), WithFunc("crash", 1, func(args ...float64) float64 {
+		return args[5]
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := vm.Eval(Var("x", 1)); err == nil {
+		t.Error("expected panic in crash to be returned as error")
+	} else if err, ok := err.(*ErrPanic); !ok || err.Func != "crash" || err.Pos != 4 {
+		t.Errorf("expected ErrPanic for crash at pos 4, got %v", err)
+	}
+}
+
+func BenchmarkBackend(b *testing.B) {
+	formulas := []struct{ name, formula string }{
+		{"Eval", "(1 * 2 / 3 + 4 - 5 * (21*z+pow(x*3, 3))) + max(x, z, 3) + sqrt(abs(x - z))"},
+		{"Calls", "sin(x) + cos(x) + pow(x, 2) + sqrt(abs(x)) + max(x, 1, 2) + min(x, 1, 2) + hypot(x, 3)"},
+		{"Logic", "if(x > 2 && z < 10 || x == z, x * z + 1, ifs(x < 0, -x, z > 3, z, 0))"},
+		{"Large", strings.Repeat("x*3 - z/2 + ", 400) + "1"},
+	}
+	backends := []struct {
+		name    string
+		backend Backend
+	}{{"Closure", BackendClosure}, {"VM", BackendVM}}
+	for _, f := range formulas {
+		for _, backend := range backends {
+			f, backend := f, backend
+			b.Run(f.name+"/"+backend.name, func(b *testing.B) {
+				formula, err := NewWithOptions(f.formula, WithBackend(backend.backend))
+				if err != nil {
+					b.Fatal(err)
+				}
+				x, z := Var("x", 4.5), Var("z", 5)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					_, _ = formula.Eval(x, z)
+				}
+			})
+		}
+	}
+}
+
+func TestFolding(t *testing.T) {
+	for _, backend := range []Backend{BackendClosure, BackendVM} {
+		formula, err := NewWithOptions("2*pi*r + pow(2, 10) * x - if(1 > 2, unknown, 0)", WithBackend(backend))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, ok := formula.AST().(*Binary); !ok {
+			t.Errorf("expected AST of formula not to be folded, got %T", formula.AST())
+		}
+		if actual, expected := formula.MustEval(Var("r", 2), Var("x", 3)), 2*math.Pi*2+math.Pow(2, 10)*3; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+		// Constants folded must still be over-ridden by variables.
+		if actual, expected := formula.MustEval(Var("r", 2), Var("x", 3), Var("pi", 3)), 2*3*2+math.Pow(2, 10)*3; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+		if _, err := formula.Eval(Var("x", 3)); err == nil {
+			t.Error("expected error evaluating formula without variable r")
+		} else if err, ok := err.(*ErrUnknownVariable); !ok || err.Var != "r" || err.Pos != 5 {
+			t.Errorf("expected ErrUnknownVariable for r at pos 5, got %v", err)
+		}
+	}
+
+	calls := 0
+	formula, err := NewWithOptions("count(1) + count(2) * x", WithFunc("count", 1, func(args ...float64) float64 {
+		calls++
+		return args[0]
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	formula.MustEval(Var("x", 1))
+	if calls != 2 {
+		t.Errorf("expected impure function to be called 2 times, got %v", calls)
+	}
+	formula.SetPure("count", true)
+	calls = 0
+	for i := 0; i < 3; i++ {
+		if actual := formula.MustEval(Var("x", 2)); actual != 5 {
+			t.Errorf("expected 5, got %v", actual)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("expected pure function to be called 2 times when folding, got %v", calls)
+	}
+
+	identities := map[string]string{
+		"x*1":                    "x",
+		"1*x + -0":               "x",
+		"(x - 0) / 1":            "x",
+		"x^(3-2) - 2*0":          "x",
+		"+x":                     "x",
+		"(1 || y) * x * (e/e)":   "x",
+		"x - (0 && y)":           "x",
+		"ifs(0, y, 1 < 2, x, y)": "x",
+	}
+	for f, expected := range identities {
+		root, err := parseFormula(f)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		root, _ = fold(root, defaultEnvironment.definitions(), false)
+		if ident, ok := root.(*Ident); !ok || ident.Name != expected {
+			t.Errorf("%v: expected formula to be folded to %v, got %#v", f, expected, root)
+		}
+	}
+	// Adding 0 changes -0 to 0, so it must not be folded away.
+	for _, f := range []string{"1/(x + 0)", "1/(0 + x)", "1/(x - -0)"} {
+		formula, err := New(f)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if actual := formula.MustEval(Var("x", math.Copysign(0, -1))); !math.IsInf(actual, 1) {
+			t.Errorf("%v: expected +Inf for x = -0, got %v", f, actual)
+		}
+	}
+}
+
+func TestFormula_Bind(t *testing.T) {
+	for _, backend := range []Backend{BackendClosure, BackendVM} {
+		formula, err := NewWithOptions("x^2 + 2*y - pi", WithBackend(backend))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		b := formula.Bind("y", "unused", "x")
+		for i := 0; i < 5; i++ {
+			x, y := float64(i), float64(i*3)
+			if actual, expected := b.MustEval(y, 1, x), math.Pow(x, 2)+2*y-math.Pi; actual != expected {
+				t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+			}
+		}
+		if _, err := b.Eval(1, 2); err == nil {
+			t.Error("expected error evaluating binding with too few values")
+		}
+		if _, err := formula.Bind("x").Eval(1); err == nil {
+			t.Error("expected error evaluating binding without variable y")
+		} else if err, ok := err.(*ErrUnknownVariable); !ok || err.Var != "y" {
+			t.Errorf("expected ErrUnknownVariable for y, got %v", err)
+		}
+		// Constants may be over-ridden by bound variables.
+		if actual, expected := formula.Bind("x", "y", "pi").MustEval(1, 2, 3), 1+2*2-3.0; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+	}
+}
+
+func BenchmarkBinding_Eval(b *testing.B) {
+	formula, err := New("(1 * 2 / 3 + 4 - 5 * (21*z+pow(x*3, 3))) + max(x, z, 3) + sqrt(abs(x - z))")
+	if err != nil {
+		b.Fatal(err)
+	}
+	binding := formula.Bind("x", "z")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = binding.Eval(4.5, 5)
+	}
+}
+
+func TestFormula_EvalBatch(t *testing.T) {
+	formulas := []string{
+		"(1 * 2 / 3 + 4 - 5 * (21*z+pow(x*3, 3))) + max(x, z, 3) + sqrt(abs(x - z))",
+		"-x^2 + 2x - ^3 + !x + 3! + x % 4 - pi",
+		"x > 2 && z < 10 || !(x == z) && x != 3 <= 4",
+		"if(x > z, x * 2, max(x, if(z > x, 1, 2)))",
+		"ifs(x > 1000, x, x > 200, 10, x < 5 && z > 1, -1, z)",
+	}
+	const rows = 1500
+	xs, zs := make([]float64, rows), make([]float64, rows)
+	for i := range xs {
+		xs[i], zs[i] = float64(i%1300)-2, float64(i%7)
+	}
+	columns := map[string][]float64{"x": xs, "z": zs, "unused": nil}
+	for _, f := range formulas {
+		formula, err := New(f)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		for _, workers := range []int{1, 3, 0} {
+			out := make([]float64, rows)
+			if err := formula.EvalBatchParallel(out, columns, workers); err != nil {
+				t.Error(err)
+				return
+			}
+			for i, actual := range out {
+				expected := formula.MustEval(Var("x", xs[i]), Var("z", zs[i]))
+				if actual != expected && !(math.IsNaN(actual) && math.IsNaN(expected)) {
+					t.Errorf("%v: expected %v for row %v, got %v", f, expected, i, actual)
+					break
+				}
+			}
+		}
+	}
+
+	formula, err := NewWithOptions("if(x < 1000, x, y) + crash(x)", WithFunc("crash", 1, func(args ...float64) float64 {
+		if args[0] == 500 {
+			panic("crash")
+		}
+		return 0
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	out := make([]float64, rows)
+	var unknown *ErrUnknownVariable
+	if err := formula.EvalBatch(out[600:], map[string][]float64{"x": xs[600:]}); !xerrors.As(err, &unknown) || unknown.Var != "y" {
+		t.Errorf("expected ErrUnknownVariable for y, got %v", err)
+	}
+	var panicked *ErrPanic
+	if err := formula.EvalBatch(out[:600], map[string][]float64{"x": xs[:600]}); !xerrors.As(err, &panicked) || panicked.Func != "crash" {
+		t.Errorf("expected ErrPanic for crash, got %v", err)
+	}
+	if err := formula.EvalBatch(out, map[string][]float64{"x": xs[:10]}); err == nil {
+		t.Error("expected error evaluating batch with a column that is too short")
+	}
+
+	// Nodes are evaluated for all rows at once, but the error of the first row that fails must be returned.
+	errFailed := xerrors.New("failed")
+	calls := 0
+	failAt := func(row float64) func(args ...float64) (float64, error) {
+		return func(args ...float64) (float64, error) {
+			calls++
+			if args[0] == row {
+				return 0, errFailed
+			}
+			return args[0], nil
+		}
+	}
+	formula, err = NewWithOptions("a(x) + b(x)", WithFuncE("a", 1, 1, failAt(5)), WithFuncE("b", 1, 1, failAt(0)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var errFunc *ErrFunc
+	err = formula.EvalBatch(out[:10], map[string][]float64{"x": xs[2:12]})
+	if !xerrors.As(err, &errFunc) || errFunc.Func != "b" || !strings.HasPrefix(err.Error(), "error evaluating row 0:") {
+		t.Errorf("expected ErrFunc for b in row 0, got %v", err)
+	}
+	// Rows are not evaluated again to find the row that failed first.
+	for _, opts := range [][]Option{nil, {WithMaxOps(10)}} {
+		formula, err := NewWithOptions("g(x) + 1", append(opts, WithFuncE("g", 1, 1, failAt(5)))...)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		calls = 0
+		err = formula.EvalBatch(out[:10], map[string][]float64{"x": xs[2:12]})
+		if !xerrors.As(err, &errFunc) || !strings.HasPrefix(err.Error(), "error evaluating row 5:") || calls != 6 {
+			t.Errorf("expected ErrFunc in row 5 after 6 calls, got %v after %v calls", err, calls)
+		}
+	}
+	formula, err = NewWithOptions("sqrt(x) + 1/y", WithStrictMath())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ys := make([]float64, 1000)
+	for i := range ys {
+		ys[i] = 1
+	}
+	ys[600] = 0
+	var divisionByZero *ErrDivisionByZero
+	err = formula.EvalBatchParallel(out[:1000], map[string][]float64{"x": {700: -1, 999: 0}, "y": ys}, 2)
+	if !xerrors.As(err, &divisionByZero) || !strings.HasPrefix(err.Error(), "error evaluating row 600:") {
+		t.Errorf("expected ErrDivisionByZero in row 600, got %v", err)
+	}
+}
+
+func BenchmarkFormula_EvalBatch(b *testing.B) {
+	formula, err := New("(1 * 2 / 3 + 4 - 5 * (21*z+pow(x*3, 3))) + max(x, z, 3) + sqrt(abs(x - z))")
+	if err != nil {
+		b.Fatal(err)
+	}
+	const rows = 10000
+	xs, zs, out := make([]float64, rows), make([]float64, rows), make([]float64, rows)
+	for i := range xs {
+		xs[i], zs[i] = float64(i), 5
+	}
+	columns := map[string][]float64{"x": xs, "z": zs}
+	b.Run("Batch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = formula.EvalBatch(out, columns)
+		}
+	})
+	b.Run("Parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = formula.EvalBatchParallel(out, columns, 0)
+		}
+	})
+	b.Run("Bind", func(b *testing.B) {
+		binding := formula.Bind("x", "z")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for row := range out {
+				out[row], _ = binding.Eval(xs[row], zs[row])
+			}
+		}
+	})
+}
+
+// must returns v, or panics if err is not nil.
+func must(v float64, err error) float64 {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func TestFormula_EvalMap(t *testing.T) {
+	formula, err := New("if(x > 2, x * y, z) + pi")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if actual, expected := must(formula.EvalMap(map[string]float64{"x": 3, "y": 4, "unused": 1})), 3*4+math.Pi; actual != expected {
+		t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+	}
+	if actual, expected := must(formula.EvalMap(map[string]float64{"x": 1, "z": 4, "pi": 3})), 4+3.0; actual != expected {
+		t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+	}
+	if _, err := formula.EvalMap(map[string]float64{"x": 3}); err == nil {
+		t.Error("expected error evaluating formula without variable y")
+	}
+
+	for _, backend := range []Backend{BackendClosure, BackendVM} {
+		formula, err := NewWithOptions("if(x > 2, x * y, z) + x + pi", WithBackend(backend))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resolved := make(map[string]int)
+		resolver := ResolverFunc(func(name string) (float64, bool) {
+			resolved[name]++
+			value, ok := map[string]float64{"x": 3, "y": 4, "pi": 3}[name]
+			return value, ok
+		})
+		if actual, expected := must(formula.EvalResolver(resolver)), 3*4+3+3.0; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+		if expected := map[string]int{"x": 1, "y": 1, "pi": 1}; !reflect.DeepEqual(resolved, expected) {
+			t.Errorf("expected variables to be resolved as %v, got %v", expected, resolved)
+		}
+	}
+}
+
+func TestFormula_EvalStruct(t *testing.T) {
+	type Base struct {
+		Tax float64 `formula:"tax"`
+	}
+	type Customer struct {
+		Discount float32 `formula:"discount"`
+		VIP      bool
+		Delay    time.Duration `formula:"delay"`
+	}
+	type Order struct {
+		Base
+		Price    float64 `formula:"price"`
+		Quantity *uint8  `formula:"qty"`
+		Ignored  float64 `formula:"-"`
+		Name     string
+		Customer *Customer `formula:"customer"`
+		internal float64
+	}
+	formula, err := New("price * qty * (1 - customer.discount) * (1 + tax) + customer.VIP + customer.delay")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	qty := uint8(3)
+	order := Order{Base: Base{Tax: 0.25}, Price: 10, Quantity: &qty, Customer: &Customer{Discount: 0.5, VIP: true, Delay: 1500 * time.Millisecond}}
+	for i := 0; i < 2; i++ {
+		if actual, expected := must(formula.EvalStruct(&order)), 10*3*0.5*1.25+1+1.5; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+	}
+	order.Customer = nil
+	if _, err := formula.EvalStruct(order); err == nil {
+		t.Error("expected error evaluating formula with nil customer")
+	}
+	if _, err := formula.EvalStruct(3); err == nil {
+		t.Error("expected error evaluating formula with non-struct value")
+	}
+	if _, err := formula.EvalStruct(struct {
+		Price string `formula:"price"`
+	}{}); err == nil {
+		t.Error("expected error evaluating formula with string field tagged")
+	}
+}
+
+func BenchmarkFormula_EvalStruct(b *testing.B) {
+	type vars struct {
+		X float64 `formula:"x"`
+		Z int     `formula:"z"`
+	}
+	formula, err := New("(1 * 2 / 3 + 4 - 5 * (21*z+pow(x*3, 3))) + max(x, z, 3) + sqrt(abs(x - z))")
+	if err != nil {
+		b.Fatal(err)
+	}
+	v := &vars{X: 4.5, Z: 5}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = formula.EvalStruct(v)
+	}
+}
+
+func TestLazyVar(t *testing.T) {
+	for _, backend := range []Backend{BackendClosure, BackendVM} {
+		formula, err := NewWithOptions("if(x > 2, rate * rate, fallback) + x * pi", WithBackend(backend))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		calls := 0
+		rate := LazyVar("rate", func() (float64, error) {
+			calls++
+			return 3, nil
+		})
+		fallback := Var("fallback", func() (float64, error) {
+			t.Error("expected fallback not to be computed")
+			return 0, nil
+		})
+		if actual, expected := formula.MustEval(Var("x", 3), rate, fallback), 3*3+3*math.Pi; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+		if calls != 1 {
+			t.Errorf("expected lazy variable to be computed once, got %v", calls)
+		}
+		// Lazy variables may over-ride constants.
+		pi := LazyVar("pi", func() (float64, error) {
+			return 3, nil
+		})
+		if actual, expected := formula.MustEval(Var("x", 3), rate, pi), 3*3+3*3.0; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+
+		errNoRate := xerrors.New("no rate")
+		_, err = formula.Eval(Var("x", 3), LazyVar("rate", func() (float64, error) {
+			return 0, errNoRate
+		}))
+		var errVar *ErrVariable
+		if !xerrors.As(err, &errVar) || errVar.Var != "rate" || errVar.Pos != 10 || !xerrors.Is(err, errNoRate) {
+			t.Errorf("expected ErrVariable for rate at pos 10 wrapping %v, got %v", errNoRate, err)
+		}
+	}
+}
+
+type celsius float64
+
+type fixed struct{ cents int64 }
+
+func (f fixed) Float64() float64 { return float64(f.cents) / 100 }
+
+func TestVarE(t *testing.T) {
+	values := map[interface{}]float64{
+		uint8(3):                3,
+		int64(-4):               -4,
+		float32(1.5):            1.5,
+		true:                    1,
+		false:                   0,
+		" 2.5e3 ":               2500,
+		json.Number("-12.25"):   -12.25,
+		big.NewInt(1 << 40):     1 << 40,
+		big.NewFloat(0.125):     0.125,
+		big.NewRat(3, 4):        0.75,
+		1500 * time.Millisecond: 1.5,
+		celsius(21.5):           21.5,
+		fixed{cents: 1999}:      19.99,
+	}
+	for value, expected := range values {
+		v, err := VarE("x", value)
+		if err != nil {
+			t.Errorf("%v (%T): %v", value, value, err)
+			continue
+		}
+		if v.value != expected {
+			t.Errorf("%v (%T): expected %v, got %v", value, value, expected, v.value)
+		}
+	}
+	for _, value := range []interface{}{"abc", "", json.Number("1,5"), (*big.Int)(nil), []float64{1}, nil} {
+		_, err := VarE("x", value)
+		var errValue *ErrInvalidValue
+		if !xerrors.As(err, &errValue) || errValue.Var != "x" {
+			t.Errorf("%v (%T): expected ErrInvalidValue, got %v", value, value, err)
+		}
+	}
+	if _, err := VarE("x", "abc"); !xerrors.Is(err, strconv.ErrSyntax) {
+		t.Errorf("expected error to wrap %v, got %v", strconv.ErrSyntax, err)
+	}
+}
+
+type contextKey struct{}
+
+func TestFormula_EvalContext(t *testing.T) {
+	for _, backend := range []Backend{BackendClosure, BackendVM} {
+		var cancel context.CancelFunc
+		formula, err := NewWithOptions("value(1) + value(2) + later",
+			WithBackend(backend),
+			WithFuncContext("value", 1, 1, func(ctx context.Context, args ...float64) float64 {
+				if args[0] == 2 {
+					cancel()
+				}
+				v, _ := ctx.Value(contextKey{}).(float64)
+				return v * args[0]
+			}),
+		)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		later := LazyVar("later", func() (float64, error) {
+			t.Error("expected lazy variable not to be computed after cancelling")
+			return 0, nil
+		})
+		ctx, c := context.WithCancel(context.WithValue(context.Background(), contextKey{}, 2.0))
+		cancel = c
+		_, err = formula.EvalContext(ctx, later)
+		var canceled *ErrCanceled
+		if !xerrors.As(err, &canceled) || canceled.Pos != 22 || !xerrors.Is(err, context.Canceled) {
+			t.Errorf("expected ErrCanceled at pos 22 wrapping %v, got %v", context.Canceled, err)
+		}
+		if _, err := formula.EvalContext(ctx, Var("later", 1)); !xerrors.As(err, &canceled) || canceled.Pos != 0 {
+			t.Errorf("expected ErrCanceled at pos 0, got %v", err)
+		}
+
+		cancel = func() {}
+		ctx = context.WithValue(context.Background(), contextKey{}, 2.0)
+		if actual, expected := must(formula.EvalContext(ctx, Var("later", 1))), 2*1+2*2+1.0; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+		// Without a context, functions receive context.Background().
+		if actual, expected := formula.MustEval(Var("later", 1)), 1.0; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey{}, 2.0))
+	defer cancel()
+	formula, err := NewWithOptions("stop(x) + value(x)",
+		WithFunc("stop", 1, func(args ...float64) float64 {
+			if args[0] == 600 {
+				cancel()
+			}
+			return 0
+		}),
+		WithFuncContext("value", 1, 1, func(ctx context.Context, args ...float64) float64 {
+			v, _ := ctx.Value(contextKey{}).(float64)
+			return v * args[0]
+		}),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	xs, out := make([]float64, 1500), make([]float64, 1500)
+	for i := range xs {
+		xs[i] = float64(i)
+	}
+	// The chunk holding row 600 is stopped before value is called for it.
+	var canceled *ErrCanceled
+	err = formula.EvalBatchContext(ctx, out, map[string][]float64{"x": xs})
+	if !xerrors.As(err, &canceled) || canceled.Pos != 10 || !xerrors.Is(err, context.Canceled) || !strings.HasPrefix(err.Error(), "error evaluating row 512:") {
+		t.Errorf("expected ErrCanceled at pos 10 in row 512 wrapping %v, got %v", context.Canceled, err)
+	}
+	if actual, expected := out[3], 6.0; actual != expected {
+		t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+	}
+	if err := formula.EvalBatchContext(ctx, out, map[string][]float64{"x": xs}); !xerrors.As(err, &canceled) || canceled.Pos != 0 {
+		t.Errorf("expected ErrCanceled at pos 0, got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	var tooLong *ErrFormulaTooLong
+	if _, err := NewWithOptions("1+2+3+4", WithMaxLength(5)); !xerrors.As(err, &tooLong) || tooLong.Length != 7 {
+		t.Errorf("expected ErrFormulaTooLong with length 7, got %v", err)
+	}
+	var tooDeep *ErrTooDeep
+	nested := strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000)
+	if _, err := NewWithOptions(nested, WithMaxDepth(50)); !xerrors.As(err, &tooDeep) || tooDeep.Pos != 50 {
+		t.Errorf("expected ErrTooDeep at pos 50, got %v", err)
+	}
+	if _, err := NewWithOptions("1+2+3+4", WithMaxDepth(3)); !xerrors.As(err, &tooDeep) || tooDeep.Pos != 0 {
+		t.Errorf("expected ErrTooDeep at pos 0, got %v", err)
+	}
+	// Without a maximum depth, the depth is still limited, so that the stack cannot be exhausted.
+	for _, f := range []string{
+		strings.Repeat("-", 2e7) + "1",
+		strings.Repeat("(", 2e7) + "1" + strings.Repeat(")", 2e7),
+		strings.Repeat("1+", 2e5) + "1",
+	} {
+		if _, err := New(f); !xerrors.As(err, &tooDeep) || tooDeep.Max != defaultMaxDepth {
+			t.Errorf("expected ErrTooDeep with maximum %v, got %v", defaultMaxDepth, err)
+		}
+	}
+	var tooManyNodes *ErrTooManyNodes
+	if _, err := NewWithOptions("1+2+3+4", WithMaxNodes(5)); !xerrors.As(err, &tooManyNodes) || tooManyNodes.Pos != 5 {
+		t.Errorf("expected ErrTooManyNodes at pos 5, got %v", err)
+	}
+	if _, err := NewWithOptions("1+2+3+4", WithMaxLength(7), WithMaxDepth(4), WithMaxNodes(7)); err != nil {
+		t.Errorf("expected no error for formula within limits: %v", err)
+	}
+
+	for _, backend := range []Backend{BackendClosure, BackendVM} {
+		var exceeded *ErrOpBudgetExceeded
+		formula, err := NewWithOptions("x*x + y*y", WithBackend(backend), WithMaxOps(6))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := formula.Eval(Var("x", 1), Var("y", 2)); !xerrors.As(err, &exceeded) || exceeded.Pos != 8 {
+			t.Errorf("expected ErrOpBudgetExceeded at pos 8, got %v", err)
+		}
+		formula, err = NewWithOptions("if(x, y*y, z) + 2*3", WithBackend(backend), WithMaxOps(5))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if actual, expected := must(formula.Eval(Var("x", 0), Var("z", 1))), 7.0; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+		// The budget is reset for every evaluation.
+		if actual, expected := must(formula.Eval(Var("x", 0), Var("z", 1))), 7.0; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+		if _, err := formula.Eval(Var("x", 1), Var("y", 2)); !xerrors.As(err, &exceeded) || exceeded.Pos != 8 {
+			t.Errorf("expected ErrOpBudgetExceeded at pos 8, got %v", err)
+		}
+		// EvalBatch applies the budget to every row.
+		out := make([]float64, 3)
+		err = formula.EvalBatch(out, map[string][]float64{"x": {0, 0, 1}, "y": {1, 2, 3}, "z": {1, 2, 3}})
+		if !xerrors.As(err, &exceeded) || exceeded.Pos != 8 || !strings.HasPrefix(err.Error(), "error evaluating row 2:") {
+			t.Errorf("expected ErrOpBudgetExceeded at pos 8 in row 2, got %v", err)
+		}
+		if err := formula.EvalBatch(out[:2], map[string][]float64{"x": {0, 0}, "z": {1, 2}}); err != nil || out[0] != 7 || out[1] != 8 {
+			t.Errorf("expected results 7 and 8, got %v (%v)", out[:2], err)
+		}
+	}
+}
+
+func TestStrictMath(t *testing.T) {
+	tests := []struct {
+		formula string
+		vars    []Variable
+		err     error
+	}{
+		{"1 / x", []Variable{Var("x", 0)}, &ErrDivisionByZero{Pos: 2}},
+		{"10 % (x - x)", []Variable{Var("x", 3)}, &ErrDivisionByZero{Pos: 3}},
+		{"0 / 0", nil, &ErrDivisionByZero{Pos: 2}},
+		{"sqrt(x)", []Variable{Var("x", -1)}, &ErrDomain{Func: "sqrt", Pos: 0}},
+		{"1 + acos(2)", nil, &ErrDomain{Func: "acos", Pos: 4}},
+		{"(-8)^(1/3)", nil, &ErrDomain{Func: "^", Pos: 4}},
+		{"exp(x) * 2", []Variable{Var("x", 1000)}, &ErrNonFinite{Value: math.Inf(1), Pos: 0}},
+		{"log(0)", nil, &ErrNonFinite{Value: math.Inf(-1), Pos: 0}},
+		{"x + 1", []Variable{Var("x", math.Inf(-1))}, &ErrNonFinite{Value: math.Inf(-1), Pos: 0}},
+		{"ifs(x, 1, 1/0, 2, 3)", []Variable{Var("x", 0)}, &ErrDivisionByZero{Pos: 11}},
+	}
+	for _, backend := range []Backend{BackendClosure, BackendVM} {
+		for _, test := range tests {
+			formula, err := NewWithOptions(test.formula, WithStrictMath(), WithBackend(backend))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := formula.Eval(test.vars...); !reflect.DeepEqual(err, test.err) {
+				t.Errorf("%v: expected error %v, got %v", test.formula, test.err, err)
+			}
+		}
+		// Constant conditions that are not finite are not folded away.
+		for f, pos := range map[string]int{"nan || x": 0, "if(nan, 1, 2)": 3, "ifs(x, 1, nan, 2, 3)": 10} {
+			formula, err := NewWithOptions(f, WithStrictMath(), WithBackend(backend))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			var nonFinite *ErrNonFinite
+			if _, err := formula.Eval(Var("x", 0)); !xerrors.As(err, &nonFinite) || !math.IsNaN(nonFinite.Value) || nonFinite.Pos != pos {
+				t.Errorf("%v: expected ErrNonFinite for NaN at pos %v, got %v", f, pos, err)
+			}
+		}
+		formula, err := NewWithOptions("if(x, 1/x, nan) + 1", WithStrictMath(), WithBackend(backend))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var nonFinite *ErrNonFinite
+		if _, err := formula.Eval(Var("x", 0)); !xerrors.As(err, &nonFinite) || nonFinite.Pos != 11 {
+			t.Errorf("expected ErrNonFinite at pos 11, got %v", err)
+		}
+		// Values that are not evaluated are not checked.
+		if actual, expected := must(formula.Eval(Var("x", 2))), 1.5; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+		if actual, expected := must(formula.Eval(Var("x", 0), Var("nan", 1))), 2.0; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+		out := make([]float64, 3)
+		var divisionByZero *ErrDivisionByZero
+		formula, err = NewWithOptions("1 / x", WithStrictMath(), WithBackend(backend))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = formula.EvalBatch(out, map[string][]float64{"x": {1, 2, 0}})
+		if !xerrors.As(err, &divisionByZero) || divisionByZero.Pos != 2 {
+			t.Errorf("expected ErrDivisionByZero at pos 2, got %v", err)
+		}
+	}
+	// Without strict math mode, the results follow IEEE 754.
+	formula, err := New("1 / x")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if actual, expected := must(formula.Eval(Var("x", 0))), math.Inf(1); actual != expected {
+		t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+	}
+}
+
+var errNoRate = xerrors.New("no rate")
+
+func TestFormula_RegisterFuncE(t *testing.T) {
+	rate := func(args ...float64) (float64, error) {
+		if args[0] != 1 {
+			return 0, errNoRate
+		}
+		return 0.5, nil
+	}
+	for _, backend := range []Backend{BackendClosure, BackendVM} {
+		formula, err := NewWithOptions("x * rate(x) + rate(2)", WithBackend(backend), WithFuncE("rate", 1, 1, rate))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Calls with constant arguments to pure functions that return an error are not folded.
+		formula.SetPure("rate", true)
+		var errFunc *ErrFunc
+		if _, err := formula.Eval(Var("x", 1)); !xerrors.As(err, &errFunc) || errFunc.Func != "rate" || errFunc.Pos != 14 || !xerrors.Is(err, errNoRate) {
+			t.Errorf("expected ErrFunc for rate at pos 14 wrapping %v, got %v", errNoRate, err)
+		}
+		// Row 1 fails at pos 4, but row 0 already fails at pos 14.
+		if err := formula.EvalBatch(make([]float64, 2), map[string][]float64{"x": {1, 2}}); !xerrors.As(err, &errFunc) || errFunc.Pos != 14 || !xerrors.Is(err, errNoRate) {
+			t.Errorf("expected ErrFunc for rate at pos 14 wrapping %v, got %v", errNoRate, err)
+		}
+
+		env := NewEnvironment()
+		env.RegisterFuncE("rate", 1, 1, rate)
+		formula, err = NewWithOptions("x * rate(x)", WithBackend(backend), WithEnvironment(env))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if actual, expected := must(formula.Eval(Var("x", 1))), 0.5; actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+		}
+		if _, err := formula.Eval(Var("x", 3)); !xerrors.As(err, &errFunc) || errFunc.Pos != 4 {
+			t.Errorf("expected ErrFunc for rate at pos 4, got %v", err)
+		}
+		out := make([]float64, 1)
+		if err := formula.EvalBatch(out, map[string][]float64{"x": {1}}); err != nil || out[0] != 0.5 {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v (%v)", out[0], 0.5, err)
+		}
+	}
+}
+
+func TestFormula_RegisterGoFunc(t *testing.T) {
+	for _, backend := range []Backend{BackendClosure, BackendVM} {
+		formula, err := NewWithOptions("gopow(x, 3) + goyn(1, x) + scaled(x, x > 1, 1, 2, 0.5) + big(abs(x)) + lookup(x)",
+			WithBackend(backend),
+			WithGoFunc("gopow", math.Pow),
+			WithGoFunc("goyn", math.Yn),
+			WithGoFunc("scaled", func(n int, scale bool, values ...float32) float64 {
+				var sum float32
+				for _, v := range values {
+					sum += v
+				}
+				if scale {
+					sum *= float32(n)
+				}
+				return float64(sum)
+			}),
+			WithGoFunc("big", func(v uint8) bool {
+				return v > 100
+			}),
+			WithGoFunc("lookup", func(ctx context.Context, id int64) (float64, error) {
+				if id < 0 {
+					return 0, errNoRate
+				}
+				v, _ := ctx.Value(contextKey{}).(float64)
+				return v, nil
+			}),
+			WithValidation(),
+		)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ctx := context.WithValue(context.Background(), contextKey{}, 4.0)
+		actual, err := formula.EvalContext(ctx, Var("x", 2.5))
+		if expected := math.Pow(2.5, 3) + math.Yn(1, 2.5) + 3.5*2 + 0 + 4; err != nil || actual != expected {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v (%v)", actual, expected, err)
+		}
+		var errFunc *ErrFunc
+		if _, err := formula.Eval(Var("x", -1)); !xerrors.As(err, &errFunc) || errFunc.Func != "lookup" || !xerrors.Is(err, errNoRate) {
+			t.Errorf("expected ErrFunc for lookup wrapping %v, got %v", errNoRate, err)
+		}
+		// Unsigned parameters cannot be passed negative values or NaN, but values truncated to 0 may be passed.
+		for x, ok := range map[float64]bool{-1: false, math.NaN(): false, -0.5: true, 300.5: true} {
+			formula, err := NewWithOptions("big(x)", WithBackend(backend), WithGoFunc("big", func(v uint) bool {
+				return v > 100
+			}))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := formula.Eval(Var("x", x)); (err == nil) != ok || (!ok && !xerrors.As(err, &errFunc)) {
+				t.Errorf("%v: expected error %v, got %v", x, !ok, err)
+			}
+		}
+		out := make([]float64, 2)
+		if err := formula.EvalBatch(out, map[string][]float64{"x": {2.5, 200}}); err != nil || out[0] != actual-4 {
+			t.Errorf("expected formula result and Go result to be equal: %v != %v (%v)", out[0], actual-4, err)
+		}
+	}
+
+	formula, err := New("1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var insufficientArgs *ErrInsufficientArgs
+	var tooManyArgs *ErrTooManyArgs
+	if err := formula.RegisterGoFunc("gopow", math.Pow); err != nil {
+		t.Error(err)
+	}
+	if err := formula.RegisterGoFunc("scaled", func(n int, values ...float64) float64 { return 0 }); err != nil {
+		t.Error(err)
+	}
+	for f, expected := range map[string]interface{}{
+		"gopow(1)":       &insufficientArgs,
+		"gopow(1, 2, 3)": &tooManyArgs,
+		"scaled()":       &insufficientArgs,
+	} {
+		formula, err := NewWithOptions(f, WithEnvironment(formula.Environment()), WithValidation())
+		if err == nil || !xerrors.As(err, expected) {
+			t.Errorf("%v: expected %T, got %v (%v)", f, expected, err, formula)
+		}
+	}
+	if _, err := NewWithOptions("scaled(1, 2, 3, 4)", WithEnvironment(formula.Environment()), WithValidation()); err != nil {
+		t.Error(err)
+	}
+	// Durations are passed and returned in seconds, like variables.
+	if err := formula.RegisterGoFunc("twice", func(d time.Duration) time.Duration { return 2 * d }); err != nil {
+		t.Error(err)
+	}
+	if f, err := NewWithOptions("twice(1.5)", WithEnvironment(formula.Environment())); err != nil {
+		t.Error(err)
+	} else if actual, expected := f.MustEval(), 3.0; actual != expected {
+		t.Errorf("expected formula result and Go result to be equal: %v != %v", actual, expected)
+	}
+
+	for _, fn := range []interface{}{
+		nil, 1, (func(float64) float64)(nil), func(string) float64 { return 0 }, func(float64) {},
+		func(float64) (float64, int) { return 0, 0 }, func(float64) error { return nil },
+	} {
+		if err := formula.RegisterGoFunc("invalid", fn); err == nil {
+			t.Errorf("%T: expected error registering func", fn)
+		}
+		if _, err := NewWithOptions("1", WithGoFunc("invalid", fn)); err == nil {
+			t.Errorf("%T: expected error registering func", fn)
+		}
+	}
+}
+
+func TestEnvironment_Functions(t *testing.T) {
+	env := NewEnvironment()
+	env.RegisterFuncRange("clamp", 3, 3, func(args ...float64) float64 {
+		return math.Max(args[1], math.Min(args[0], args[2]))
+	})
+	env.Describe("clamp", "Limits x to the range [min, max].", "x", "min", "max")
+	env.RegisterFuncRange("round2", 1, 2, func(args ...float64) float64 {
+		return math.Round(args[0])
+	})
+	env.Describe("unknown", "Has no effect.")
+
+	infos := env.Functions()
+	if !sort.SliceIsSorted(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name }) {
+		t.Error("expected functions to be sorted by name")
+	}
+	signatures := make(map[string]string, len(infos))
+	for _, info := range infos {
+		signatures[info.Name] = info.Signature()
+	}
+	for name, expected := range map[string]string{
+		"clamp":  "clamp(x, min, max)",
+		"round2": "round2(x1, [x2])",
+		"pow":    "pow(x, y)",
+		"max":    "max(x, ...)",
+		"if":     "if(cond, then, else)",
+		"ifs":    "ifs(cond, value, else, ...)",
+	} {
+		if signatures[name] != expected {
+			t.Errorf("expected signature %v, got %v", expected, signatures[name])
+		}
+	}
+	for _, info := range NewEnvironment().Functions() {
+		if info.Description == "" || len(info.Params) != info.MinArgs {
+			t.Errorf("expected default function %v to have a description and %v parameter names", info.Name, info.MinArgs)
+		}
+	}
+	if _, ok := signatures["unknown"]; ok {
+		t.Error("expected describing an unknown function to have no effect")
+	}
+
+	info, ok := env.Function("clamp")
+	expected := FuncInfo{Name: "clamp", Description: "Limits x to the range [min, max].", Params: []string{"x", "min", "max"}, MinArgs: 3, MaxArgs: 3}
+	if !ok || !reflect.DeepEqual(info, expected) {
+		t.Errorf("expected %+v, got %+v", expected, info)
+	}
+	if info, ok := env.Function("max"); !ok || !info.Variadic || info.MaxArgs != Variadic || !info.Pure || info.Description == "" {
+		t.Errorf("expected pure variadic max with description, got %+v", info)
+	}
+	// Modifying the FuncInfo returned must not affect other callers.
+	info, _ = env.Function("if")
+	info.Params[0] = "modified"
+	for _, info := range env.Functions() {
+		if info.Name == "if" {
+			info.Params[1] = "modified"
+		}
+	}
+	if info, _ := env.Function("if"); info.Signature() != "if(cond, then, else)" {
+		t.Errorf("expected signature if(cond, then, else), got %v", info.Signature())
+	}
+	// Registering a function again removes its description.
+	env.RegisterFunc("clamp", 3, func(args ...float64) float64 { return 0 })
+	if info, _ := env.Function("clamp"); info.Description != "" || info.Params != nil || !info.Variadic {
+		t.Errorf("expected variadic clamp without description, got %+v", info)
+	}
+
+	formula, err := NewWithOptions("double(x)", WithFuncRange("double", 1, 1, func(args ...float64) float64 {
+		return args[0] * 2
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	formula.Describe("double", "Returns x times 2.", "x")
+	if info, ok := formula.Environment().Function("double"); !ok || info.Signature() != "double(x)" || info.Description != "Returns x times 2." {
+		t.Errorf("expected described double, got %+v", info)
+	}
+	if _, ok := defaultEnvironment.Function("double"); ok {
+		t.Error("expected describing a function of a formula not to affect the default environment")
+	}
+}
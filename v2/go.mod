@@ -1,3 +1,5 @@
 module github.com/sandertv/go-formula/v2
 
 go 1.12
+
+require golang.org/x/xerrors v0.0.0-20240903120638-7835f813f4da
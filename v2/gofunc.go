@@ -0,0 +1,198 @@
+package formula
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	contextType  = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType    = reflect.TypeOf((*error)(nil)).Elem()
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// goFunc returns an availableFunc that calls the Go function passed, which must be a func as described in
+// Formula.RegisterGoFunc. The number of arguments accepted is that of the parameters of the function.
+// Functions with common signatures, such as func(float64, float64) float64, are called directly. Other
+// functions are called using reflection.
+func goFunc(fn interface{}) (availableFunc, error) {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil() {
+		return availableFunc{}, xerrors.Errorf("expected non-nil func, got %T", fn)
+	}
+	t := v.Type()
+	params := make([]reflect.Type, 0, t.NumIn())
+	withContext := t.NumIn() > 0 && t.In(0) == contextType
+	for i := 0; i < t.NumIn(); i++ {
+		if i == 0 && withContext {
+			continue
+		}
+		param := t.In(i)
+		if i == t.NumIn()-1 && t.IsVariadic() {
+			param = param.Elem()
+		}
+		if !isNumeric(param) {
+			return availableFunc{}, xerrors.Errorf("parameter %v of %v has type %v: must be numeric or bool", i, t, t.In(i))
+		}
+		params = append(params, param)
+	}
+	switch {
+	case t.NumOut() == 0 || t.NumOut() > 2:
+		return availableFunc{}, xerrors.Errorf("%v must return one value, optionally followed by an error", t)
+	case !isNumeric(t.Out(0)):
+		return availableFunc{}, xerrors.Errorf("%v returns %v: must be numeric or bool", t, t.Out(0))
+	case t.NumOut() == 2 && t.Out(1) != errorType:
+		return availableFunc{}, xerrors.Errorf("%v returns %v as second value: must be error", t, t.Out(1))
+	}
+
+	f := availableFunc{paramCount: len(params), maxParamCount: len(params)}
+	if t.IsVariadic() {
+		f.paramCount, f.maxParamCount = len(params)-1, Variadic
+	}
+	if fastGoFunc(fn, &f) {
+		return f, nil
+	}
+	f.contextFunction = reflectGoFunc(v, params, withContext)
+	return f, nil
+}
+
+// fastGoFunc sets the function or contextFunction of the availableFunc passed to an adapter calling fn
+// directly if fn has one of the common signatures below. If it has another signature, false is returned.
+func fastGoFunc(fn interface{}, f *availableFunc) bool {
+	switch fn := fn.(type) {
+	case func(...float64) float64:
+		f.function = fn
+	case func(float64) float64:
+		f.function = func(args ...float64) float64 {
+			return fn(args[0])
+		}
+	case func(float64, float64) float64:
+		f.function = func(args ...float64) float64 {
+			return fn(args[0], args[1])
+		}
+	case func(float64, float64, float64) float64:
+		f.function = func(args ...float64) float64 {
+			return fn(args[0], args[1], args[2])
+		}
+	case func(int, float64) float64:
+		f.function = func(args ...float64) float64 {
+			return fn(int(args[0]), args[1])
+		}
+	case func(...float64) (float64, error):
+		f.contextFunction = withError(fn)
+	case func(float64) (float64, error):
+		f.contextFunction = func(ctx context.Context, args ...float64) (float64, error) {
+			return fn(args[0])
+		}
+	case func(float64, float64) (float64, error):
+		f.contextFunction = func(ctx context.Context, args ...float64) (float64, error) {
+			return fn(args[0], args[1])
+		}
+	case func(context.Context, ...float64) (float64, error):
+		f.contextFunction = fn
+	default:
+		return false
+	}
+	return true
+}
+
+// reflectGoFunc returns a function that may be used as contextFunction of an availableFunc, which calls the
+// function v using reflection. params holds the types of the parameters of v, excluding the context.Context
+// if withContext is true. If v is variadic, the last type is the type of the variadic arguments.
+func reflectGoFunc(v reflect.Value, params []reflect.Type, withContext bool) func(ctx context.Context, args ...float64) (float64, error) {
+	converters := make([]func(float64) (reflect.Value, error), len(params))
+	for i, param := range params {
+		converters[i] = converter(param)
+	}
+	returnsError := v.Type().NumOut() == 2
+	return func(ctx context.Context, args ...float64) (float64, error) {
+		in := make([]reflect.Value, 0, len(args)+1)
+		if withContext {
+			in = append(in, reflect.ValueOf(&ctx).Elem())
+		}
+		for i, arg := range args {
+			// Variadic arguments all have the type of the last parameter.
+			if last := len(converters) - 1; i > last {
+				i = last
+			}
+			value, err := converters[i](arg)
+			if err != nil {
+				return 0, err
+			}
+			in = append(in, value)
+		}
+		out := v.Call(in)
+		if returnsError && !out[1].IsNil() {
+			return 0, out[1].Interface().(error)
+		}
+		value, _ := numericValue(out[0])
+		return value, nil
+	}
+}
+
+// converter returns a function that converts a float64 to a reflect.Value of the numeric or bool type passed.
+// Values converted to integer types are truncated towards zero. Values converted to unsigned integer types
+// must not be negative after truncating or NaN, as these have no unsigned value, in which case an error is
+// returned. Values converted to time.Duration are a number of seconds, like variables of that type.
+func converter(t reflect.Type) func(float64) (reflect.Value, error) {
+	if t == durationType {
+		return func(f float64) (reflect.Value, error) {
+			return reflect.ValueOf(time.Duration(f * float64(time.Second))), nil
+		}
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(f float64) (reflect.Value, error) {
+			return reflect.ValueOf(int64(f)).Convert(t), nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(f float64) (reflect.Value, error) {
+			// This is also false for NaN.
+			if !(f > -1) {
+				return reflect.Value{}, xerrors.Errorf("cannot pass %v as %v", f, t)
+			}
+			return reflect.ValueOf(uint64(f)).Convert(t), nil
+		}
+	case reflect.Bool:
+		return func(f float64) (reflect.Value, error) {
+			return reflect.ValueOf(f != 0).Convert(t), nil
+		}
+	}
+	return func(f float64) (reflect.Value, error) {
+		return reflect.ValueOf(f).Convert(t), nil
+	}
+}
+
+// isNumeric checks if the type passed has a numeric or bool kind.
+func isNumeric(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+		return true
+	}
+	return false
+}
+
+// numericValue returns the value passed, which must have a numeric or bool kind, as float64. Bools are 1 if
+// true and 0 if false and a time.Duration is its number of seconds, like Var does. If v does not have one of
+// these kinds, false is returned.
+func numericValue(v reflect.Value) (float64, bool) {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).Seconds(), true
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Bool:
+		return boolToFloat64(v.Bool()), true
+	}
+	return 0, false
+}
@@ -0,0 +1,283 @@
+package formula
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Precedences of the operators in a formula, from lowest to highest.
+const (
+	precLowest = iota
+	precLOr
+	precLAnd
+	precCompare
+	precAdd
+	precMul
+	precPrefix
+	precPow
+	precPostfix
+)
+
+// binaryOperators maps every token that may be used as binary operator to the operator it represents and
+// its precedence. The exponent operator is not in this map, as it is right associative.
+var binaryOperators = map[tokenKind]struct {
+	op   Op
+	prec int
+}{
+	tokenLOr:  {OpLOr, precLOr},
+	tokenLAnd: {OpLAnd, precLAnd},
+	tokenEql:  {OpEql, precCompare},
+	tokenNeq:  {OpNeq, precCompare},
+	tokenLss:  {OpLss, precCompare},
+	tokenLeq:  {OpLeq, precCompare},
+	tokenGtr:  {OpGtr, precCompare},
+	tokenGeq:  {OpGeq, precCompare},
+	tokenAdd:  {OpAdd, precAdd},
+	tokenSub:  {OpSub, precAdd},
+	tokenMul:  {OpMul, precMul},
+	tokenQuo:  {OpQuo, precMul},
+	tokenRem:  {OpRem, precMul},
+}
+
+// exprParser is a Pratt parser that parses the tokens produced by a lexer into the AST of a formula.
+//
+// From lowest to highest precedence, formulas support the operators ||, &&, comparisons (==, !=, <, <=, >,
+// >=), + and -, * / and %, prefix operators (-x, +x, !x and ^x), the exponent operator (x^y or x**y) and the
+// postfix factorial (x!). All binary operators are left associative, except for the exponent operator,
+// which is right associative, so that -x^2 is parsed as -(x^2) and 2^3^2 as 2^(3^2).
+//
+// A number directly followed by an identifier or parenthesised expression is multiplied with it, so that
+// 2x is equal to 2*x and 3(x+1) to 3*(x+1).
+type exprParser struct {
+	lexer lexer
+	// tok is the current token.
+	tok token
+	// prev is the kind of the token before tok.
+	prev tokenKind
+	// limits holds the maximum depth and number of nodes of the AST.
+	limits limits
+	// depth is the current level of nesting of parseExpr and nodes the number of nodes created so far.
+	depth, nodes int
+}
+
+// parseFormula parses the formula passed into an AST. An error is returned if the formula did not follow the
+// grammar.
+func parseFormula(formula string) (Node, error) {
+	return parseFormulaLimits(formula, limits{})
+}
+
+// parseFormulaLimits parses the formula passed into an AST like parseFormula. Parsing is stopped as soon as the
+// maximum depth or number of nodes in the limits passed is exceeded, in which case ErrTooDeep or
+// ErrTooManyNodes is returned. Because parsing stops at the maximum depth, which is defaultMaxDepth if the
+// limits have none, deeply nested formulas cannot exhaust the stack.
+func parseFormulaLimits(formula string, l limits) (Node, error) {
+	l.maxDepth = l.depth()
+	p := &exprParser{lexer: lexer{formula: formula}, limits: l}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	n, err := p.parseExpr(precLowest)
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokenEOF {
+		return nil, p.unexpected()
+	}
+	return n, nil
+}
+
+// next advances the parser to the next token.
+func (p *exprParser) next() (err error) {
+	p.prev = p.tok.kind
+	p.tok, err = p.lexer.next()
+	return err
+}
+
+// unexpected returns an error for the current token, which was not expected at its position.
+func (p *exprParser) unexpected() error {
+	switch p.tok.kind {
+	case tokenEOF:
+		return fmt.Errorf("unexpected end of formula (pos:%d)", p.tok.pos)
+	case tokenNumber, tokenIdent:
+		return fmt.Errorf("unexpected %v '%v' (pos:%d)", p.tok.kind, p.tok.lit, p.tok.pos)
+	}
+	return fmt.Errorf("unexpected '%v' (pos:%d)", p.tok.lit, p.tok.pos)
+}
+
+// expect checks if the current token is of the kind passed and advances to the next token if so. An error
+// is returned if it was not.
+func (p *exprParser) expect(kind tokenKind) error {
+	if p.tok.kind != kind {
+		found := p.tok.kind.String()
+		if p.tok.kind != tokenEOF {
+			found = "'" + p.tok.lit + "'"
+		}
+		return fmt.Errorf("expected '%v', found %v (pos:%d)", kind, found, p.tok.pos)
+	}
+	return p.next()
+}
+
+// count counts a node created at the position passed. If the maximum number of nodes is exceeded,
+// ErrTooManyNodes is returned.
+func (p *exprParser) count(pos int) error {
+	p.nodes++
+	if p.limits.maxNodes > 0 && p.nodes > p.limits.maxNodes {
+		return &ErrTooManyNodes{Pos: pos, Max: p.limits.maxNodes}
+	}
+	return nil
+}
+
+// parseExpr parses an expression consisting of operators with a precedence higher than prec.
+func (p *exprParser) parseExpr(prec int) (Node, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > p.limits.maxDepth {
+		return nil, &ErrTooDeep{Pos: p.tok.pos, Max: p.limits.maxDepth}
+	}
+	x, err := p.parsePrefix()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.tok
+		switch {
+		case tok.kind == tokenNot && precPostfix > prec:
+			if err := p.count(tok.pos); err != nil {
+				return nil, err
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			x = &Unary{OpPos: tok.pos, Op: OpFactorial, X: x}
+		case tok.kind == tokenPow && precPow > prec:
+			if err := p.count(tok.pos); err != nil {
+				return nil, err
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			// Parse with a lower precedence than precPow, so that the operator is right associative.
+			y, err := p.parseExpr(precPow - 1)
+			if err != nil {
+				return nil, err
+			}
+			x = &Binary{OpPos: tok.pos, Op: OpPow, X: x, Y: y}
+		case p.prev == tokenNumber && (tok.kind == tokenIdent || tok.kind == tokenLParen) && precMul > prec:
+			// Implicit multiplication, such as 2x. There is no operator, so the position of the second
+			// operand is used instead.
+			if err := p.count(tok.pos); err != nil {
+				return nil, err
+			}
+			y, err := p.parseExpr(precMul)
+			if err != nil {
+				return nil, err
+			}
+			x = &Binary{OpPos: tok.pos, Op: OpMul, X: x, Y: y}
+		default:
+			binary, ok := binaryOperators[tok.kind]
+			if !ok || binary.prec <= prec {
+				return x, nil
+			}
+			if err := p.count(tok.pos); err != nil {
+				return nil, err
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			y, err := p.parseExpr(binary.prec)
+			if err != nil {
+				return nil, err
+			}
+			x = &Binary{OpPos: tok.pos, Op: binary.op, X: x, Y: y}
+		}
+	}
+}
+
+// parsePrefix parses a number, identifier, call, parenthesised expression or an expression with a prefix
+// operator.
+func (p *exprParser) parsePrefix() (Node, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokenNumber, tokenIdent, tokenSub, tokenAdd, tokenNot, tokenPow:
+		// Every one of these creates a number, identifier, call or unary expression.
+		if err := p.count(tok.pos); err != nil {
+			return nil, err
+		}
+	}
+	switch tok.kind {
+	case tokenNumber:
+		value, err := strconv.ParseFloat(tok.lit, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %v (pos:%d)", tok.lit, tok.pos)
+		}
+		return &Number{ValuePos: tok.pos, Literal: tok.lit, Value: value}, p.next()
+	case tokenIdent:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == tokenLParen {
+			return p.parseCall(tok)
+		}
+		return &Ident{NamePos: tok.pos, Name: tok.lit}, nil
+	case tokenLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseExpr(precLowest)
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(tokenRParen)
+	case tokenSub, tokenAdd, tokenNot, tokenPow:
+		var op Op
+		switch {
+		case tok.kind == tokenSub:
+			op = OpSub
+		case tok.kind == tokenAdd:
+			op = OpAdd
+		case tok.kind == tokenNot:
+			op = OpNot
+		case tok.lit == "^":
+			op = OpBitNot
+		default:
+			// ** has no meaning as prefix operator.
+			return nil, p.unexpected()
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseExpr(precPrefix)
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{OpPos: tok.pos, Op: op, X: x}, nil
+	}
+	return nil, p.unexpected()
+}
+
+// parseCall parses the arguments of a call to the function with the name held by the token passed. The
+// current token must be the opening parenthesis of the call.
+func (p *exprParser) parseCall(name token) (Node, error) {
+	call := &Call{NamePos: name.pos, Name: name.lit}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokenRParen {
+		return call, p.next()
+	}
+	for {
+		// An argument must follow every comma, so that max(1,) is not accepted.
+		arg, err := p.parseExpr(precLowest)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+		if p.tok.kind != tokenComma {
+			break
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	return call, p.expect(tokenRParen)
+}
@@ -0,0 +1,227 @@
+package formula
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokenKind is the kind of a token produced by the lexer.
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenIdent
+	tokenLParen
+	tokenRParen
+	tokenComma
+
+	tokenAdd  // +
+	tokenSub  // -
+	tokenMul  // *
+	tokenQuo  // /
+	tokenRem  // %
+	tokenPow  // ^ or **
+	tokenNot  // !
+	tokenEql  // ==
+	tokenNeq  // !=
+	tokenLss  // <
+	tokenLeq  // <=
+	tokenGtr  // >
+	tokenGeq  // >=
+	tokenLAnd // &&
+	tokenLOr  // ||
+)
+
+// tokenNames holds a readable name for every token kind, used in error messages.
+var tokenNames = [...]string{
+	tokenEOF:    "end of formula",
+	tokenNumber: "number",
+	tokenIdent:  "identifier",
+	tokenLParen: "(",
+	tokenRParen: ")",
+	tokenComma:  ",",
+	tokenAdd:    "+",
+	tokenSub:    "-",
+	tokenMul:    "*",
+	tokenQuo:    "/",
+	tokenRem:    "%",
+	tokenPow:    "^",
+	tokenNot:    "!",
+	tokenEql:    "==",
+	tokenNeq:    "!=",
+	tokenLss:    "<",
+	tokenLeq:    "<=",
+	tokenGtr:    ">",
+	tokenGeq:    ">=",
+	tokenLAnd:   "&&",
+	tokenLOr:    "||",
+}
+
+// String returns the name of the token kind.
+func (kind tokenKind) String() string {
+	return tokenNames[kind]
+}
+
+// token is a single token in a formula.
+type token struct {
+	kind tokenKind
+	// pos is the character position of the first character of the token in the formula.
+	pos int
+	// lit is the literal text of the token.
+	lit string
+}
+
+// lexer splits a formula up into tokens.
+type lexer struct {
+	// formula is the formula that is lexed.
+	formula string
+	// offset is the character position of the next character that is read.
+	offset int
+}
+
+// next returns the next token in the formula. A token with the kind tokenEOF is returned once the end of the
+// formula is reached. If a character was found that is not valid in a formula, an error is returned.
+func (l *lexer) next() (token, error) {
+	l.skipSpace()
+	start := l.offset
+	if start >= len(l.formula) {
+		return token{kind: tokenEOF, pos: start}, nil
+	}
+	r, size := utf8.DecodeRuneInString(l.formula[start:])
+	switch {
+	case isDigit(r) || r == '.' && start+1 < len(l.formula) && isDigit(rune(l.formula[start+1])):
+		return l.number(), nil
+	case isIdentStart(r):
+		return l.ident(), nil
+	}
+	l.offset += size
+
+	kind := tokenEOF
+	switch r {
+	case '(':
+		kind = tokenLParen
+	case ')':
+		kind = tokenRParen
+	case ',':
+		kind = tokenComma
+	case '+':
+		kind = tokenAdd
+	case '-':
+		kind = tokenSub
+	case '*':
+		kind = l.either('*', tokenPow, tokenMul)
+	case '/':
+		kind = tokenQuo
+	case '%':
+		kind = tokenRem
+	case '^':
+		kind = tokenPow
+	case '!':
+		kind = l.either('=', tokenNeq, tokenNot)
+	case '<':
+		kind = l.either('=', tokenLeq, tokenLss)
+	case '>':
+		kind = l.either('=', tokenGeq, tokenGtr)
+	case '=':
+		kind = l.either('=', tokenEql, tokenEOF)
+	case '&':
+		kind = l.either('&', tokenLAnd, tokenEOF)
+	case '|':
+		kind = l.either('|', tokenLOr, tokenEOF)
+	}
+	if kind == tokenEOF {
+		return token{}, fmt.Errorf("unexpected character '%v' (pos:%d)", l.formula[start:l.offset], start)
+	}
+	return token{kind: kind, pos: start, lit: l.formula[start:l.offset]}, nil
+}
+
+// either returns match and consumes the next character if it is equal to c. If it is not, otherwise is
+// returned.
+func (l *lexer) either(c byte, match, otherwise tokenKind) tokenKind {
+	if l.offset < len(l.formula) && l.formula[l.offset] == c {
+		l.offset++
+		return match
+	}
+	return otherwise
+}
+
+// skipSpace skips all white space at the current position in the formula.
+func (l *lexer) skipSpace() {
+	for l.offset < len(l.formula) {
+		r, size := utf8.DecodeRuneInString(l.formula[l.offset:])
+		if !unicode.IsSpace(r) {
+			return
+		}
+		l.offset += size
+	}
+}
+
+// number lexes a number, which consists of digits, optionally followed by a decimal point and more digits
+// and optionally followed by an exponent, such as 1.5e-3. The number may also start with a decimal point.
+func (l *lexer) number() token {
+	start := l.offset
+	l.digits()
+	if l.peek(0) == '.' {
+		l.offset++
+		l.digits()
+	}
+	if c := l.peek(0); c == 'e' || c == 'E' {
+		// Only treat the e as exponent if digits follow, so that 2e remains 2 followed by the constant e.
+		n := 1
+		if c := l.peek(1); c == '+' || c == '-' {
+			n++
+		}
+		if isDigit(rune(l.peek(n))) {
+			l.offset += n
+			l.digits()
+		}
+	}
+	return token{kind: tokenNumber, pos: start, lit: l.formula[start:l.offset]}
+}
+
+// digits consumes all consecutive decimal digits at the current position.
+func (l *lexer) digits() {
+	for l.offset < len(l.formula) && isDigit(rune(l.formula[l.offset])) {
+		l.offset++
+	}
+}
+
+// peek returns the character n characters after the current position, or 0 if the formula is not long
+// enough.
+func (l *lexer) peek(n int) byte {
+	if l.offset+n < len(l.formula) {
+		return l.formula[l.offset+n]
+	}
+	return 0
+}
+
+// ident lexes an identifier. Identifiers start with a letter or underscore, followed by letters, digits and
+// underscores. A dot may be used to separate parts of an identifier, such as in order.total.
+func (l *lexer) ident() token {
+	start := l.offset
+	for l.offset < len(l.formula) {
+		r, size := utf8.DecodeRuneInString(l.formula[l.offset:])
+		if r == '.' {
+			next, _ := utf8.DecodeRuneInString(l.formula[l.offset+size:])
+			if !isIdentStart(next) {
+				break
+			}
+		} else if !isIdentStart(r) && !unicode.IsDigit(r) {
+			break
+		}
+		l.offset += size
+	}
+	return token{kind: tokenIdent, pos: start, lit: l.formula[start:l.offset]}
+}
+
+// isDigit checks if r is a decimal digit.
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// isIdentStart checks if r may be the first character of an identifier.
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
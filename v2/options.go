@@ -0,0 +1,230 @@
+package formula
+
+import (
+	"context"
+
+	"golang.org/x/xerrors"
+)
+
+// Option is an option that may be passed to NewWithOptions to change the behaviour of a formula.
+type Option func(o *options)
+
+// options holds the options that a formula is created with.
+type options struct {
+	// defaults specifies if the default functions and constants are available in the formula.
+	defaults bool
+	// functions holds custom functions registered using WithFunc and WithFuncRange, in the order they were
+	// passed.
+	functions []namedFunc
+	// constants holds the custom constants added using WithConstants.
+	constants map[string]float64
+	// validate specifies if the formula is validated after it is parsed.
+	validate bool
+	// env is the Environment passed using WithEnvironment, or nil if none was passed.
+	env *Environment
+	limits
+	// backend is the backend used to evaluate the formula.
+	backend Backend
+	// strict specifies if the formula is evaluated in strict math mode.
+	strict bool
+	// err is the first error that occurred applying an option, such as WithGoFunc.
+	err error
+}
+
+// defaultMaxDepth is the maximum depth of the AST of a formula if no maximum was set using WithMaxDepth. The
+// AST is traversed recursively, so without a maximum, deeply nested formulas could exhaust the stack.
+const defaultMaxDepth = 100000
+
+// limits holds the limits on the resources used by a formula. A limit of 0 means there is no limit, except for
+// the depth of the AST, which is limited to defaultMaxDepth.
+type limits struct {
+	// maxLength is the maximum length of the formula in bytes.
+	maxLength int
+	// maxDepth is the maximum depth of the AST of the formula, as returned by depth.
+	maxDepth int
+	// maxNodes is the maximum number of nodes in the AST of the formula.
+	maxNodes int
+	// maxOps is the maximum number of operations performed by a single evaluation of the formula.
+	maxOps int
+}
+
+// depth returns the maximum depth of the AST of the formula, which is defaultMaxDepth if no maximum was set.
+func (l limits) depth() int {
+	if l.maxDepth <= 0 {
+		return defaultMaxDepth
+	}
+	return l.maxDepth
+}
+
+// namedFunc is an availableFunc along with the name it is registered with.
+type namedFunc struct {
+	availableFunc
+	name string
+}
+
+// WithFunc registers a custom function in the formula. It is equivalent to calling Formula.RegisterFunc
+// after creating the formula.
+func WithFunc(name string, paramCount int, f func(args ...float64) float64) Option {
+	return WithFuncRange(name, paramCount, Variadic, f)
+}
+
+// WithFuncRange registers a custom function with a maximum number of arguments in the formula. It is
+// equivalent to calling Formula.RegisterFuncRange after creating the formula.
+func WithFuncRange(name string, paramCount, maxParamCount int, f func(args ...float64) float64) Option {
+	return func(o *options) {
+		o.functions = append(o.functions, namedFunc{
+			availableFunc: availableFunc{function: f, paramCount: paramCount, maxParamCount: maxParamCount},
+			name:          name,
+		})
+	}
+}
+
+// WithFuncContext registers a custom function that receives the context passed to Formula.EvalContext in the
+// formula. It is equivalent to calling Formula.RegisterFuncContext after creating the formula.
+func WithFuncContext(name string, paramCount, maxParamCount int, f func(ctx context.Context, args ...float64) float64) Option {
+	return func(o *options) {
+		o.functions = append(o.functions, namedFunc{
+			availableFunc: availableFunc{contextFunction: withContext(f), paramCount: paramCount, maxParamCount: maxParamCount},
+			name:          name,
+		})
+	}
+}
+
+// WithFuncE registers a custom function that may return an error in the formula. It is equivalent to calling
+// Formula.RegisterFuncE after creating the formula.
+func WithFuncE(name string, paramCount, maxParamCount int, f func(args ...float64) (float64, error)) Option {
+	return func(o *options) {
+		o.functions = append(o.functions, namedFunc{
+			availableFunc: availableFunc{contextFunction: withError(f), paramCount: paramCount, maxParamCount: maxParamCount},
+			name:          name,
+		})
+	}
+}
+
+// WithGoFunc registers a Go function in the formula. It is equivalent to calling Formula.RegisterGoFunc after
+// creating the formula. If fn cannot be registered, NewWithOptions returns an error.
+func WithGoFunc(name string, fn interface{}) Option {
+	return func(o *options) {
+		f, err := goFunc(fn)
+		if err != nil {
+			if o.err == nil {
+				o.err = xerrors.Errorf("cannot register func %v: %w", name, err)
+			}
+			return
+		}
+		o.functions = append(o.functions, namedFunc{availableFunc: f, name: name})
+	}
+}
+
+// WithoutDefaults disables the default functions, such as sin and pow, and constants, such as π and e, in the
+// formula. Only functions and constants added explicitly are available. WithoutDefaults has no effect if
+// WithEnvironment is passed.
+func WithoutDefaults() Option {
+	return func(o *options) {
+		o.defaults = false
+	}
+}
+
+// WithConstants adds the constants passed to the formula. Like the default constants, they are available
+// in the formula unless over-ridden by a variable with the same name passed to Eval.
+func WithConstants(constants map[string]float64) Option {
+	return func(o *options) {
+		if o.constants == nil {
+			o.constants = make(map[string]float64, len(constants))
+		}
+		for name, value := range constants {
+			o.constants[name] = value
+		}
+	}
+}
+
+// WithEnvironment creates the formula with the functions and constants held by the Environment passed,
+// instead of the default ones. The Environment may be shared by many formulas: Functions and constants added
+// to the formula, using WithFunc, WithConstants or Formula.RegisterFunc, do not affect the Environment. Note
+// that once this is done, functions and constants added to the Environment afterwards are no longer seen by
+// the formula.
+func WithEnvironment(env *Environment) Option {
+	return func(o *options) {
+		o.env = env
+	}
+}
+
+// WithValidation validates the formula when it is created, as if Formula.Validate was called after
+// registering all functions passed using WithFunc. If the formula calls an unknown function or passes an
+// invalid number of arguments to it, NewWithOptions returns an error.
+func WithValidation() Option {
+	return func(o *options) {
+		o.validate = true
+	}
+}
+
+// WithMaxDepth limits the depth of the AST of the formula to maxDepth. A formula such as 1+2 has a depth of 2.
+// If the formula is nested deeper, NewWithOptions returns ErrTooDeep. The formula is checked while it is
+// parsed, so that deeply nested formulas are rejected before they are parsed completely. While parsing,
+// parentheses that do not change the AST, such as in ((x)), count as a level of nesting too. Without
+// WithMaxDepth, the depth is limited to 100000.
+func WithMaxDepth(maxDepth int) Option {
+	return func(o *options) {
+		o.maxDepth = maxDepth
+	}
+}
+
+// WithMaxLength limits the length of the formula to maxLength bytes. If the formula is longer,
+// NewWithOptions returns ErrFormulaTooLong without parsing it.
+func WithMaxLength(maxLength int) Option {
+	return func(o *options) {
+		o.maxLength = maxLength
+	}
+}
+
+// WithMaxNodes limits the number of nodes in the AST of the formula, which are its numbers, identifiers,
+// calls and operators, to maxNodes. A formula such as 1+2 has 3 nodes. If the formula has more nodes,
+// NewWithOptions returns ErrTooManyNodes.
+func WithMaxNodes(maxNodes int) Option {
+	return func(o *options) {
+		o.maxNodes = maxNodes
+	}
+}
+
+// WithMaxOps limits the number of operations performed by a single evaluation of the formula to maxOps.
+// Every number, variable, operator and call that is evaluated counts as one operation. Values that are not
+// evaluated, such as the value not selected by if, do not count. Constant parts of the formula are folded
+// before it is evaluated, so that they count as a single operation. If an evaluation exceeds the budget, it
+// is stopped and ErrOpBudgetExceeded is returned.
+//
+// The budget applies to every evaluation separately. EvalBatch applies it to every row, which it evaluates one
+// by one like Eval if the formula has a budget.
+func WithMaxOps(maxOps int) Option {
+	return func(o *options) {
+		o.maxOps = maxOps
+	}
+}
+
+// WithStrictMath evaluates the formula in strict math mode. By default, operations follow IEEE 754, so that
+// 1/0 results in +Inf and sqrt(-1) in NaN, which may then silently become the result of the formula. In strict
+// math mode, the evaluation is stopped instead and an error is returned with the position of the part of the
+// formula that failed:
+//
+//  ErrDivisionByZero: x / 0 and x % 0
+//  ErrDomain: A function or operator resulting in NaN, such as sqrt(-1), log(-1), acos(2) or (-8)^(1/3)
+//  ErrNonFinite: Any other infinite or NaN value, such as exp(1000), log(0) or a variable that is NaN
+//
+// Strict math mode applies to all methods evaluating the formula, including EvalBatch.
+func WithStrictMath() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
+// WithBackend sets the backend used to evaluate the formula. By default, BackendClosure is used. Results and
+// errors are the same for every backend, but their performance differs.
+//
+// Example:
+//
+//  f, err := formula.NewWithOptions("x^2 + 2x + 1", formula.WithBackend(formula.BackendVM))
+//
+func WithBackend(backend Backend) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
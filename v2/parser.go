@@ -1,71 +1,258 @@
 package formula
 
 import (
+	"context"
 	"fmt"
-	"go/ast"
-	"go/parser"
-	"go/token"
 	"math"
-	"reflect"
 	"runtime"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
 )
 
-// astParser handles the parsing of the AST produced by parsing the formula passed into the astParser as an
-// AST expression. It 'links' functions and variables when they are encountered.
+// astParser handles the parsing of the AST produced by parseFormula into functions that may be executed to
+// evaluate the formula. It 'links' functions and variables when they are encountered: Functions are looked
+// up once, when the formula is parsed, instead of every time the formula is evaluated.
 type astParser struct {
 	// formula is the formula that ought to be parsed.
 	formula string
 	// functions is a map of functions added to the formula which may be executed by the formula. The
 	// functions are indexed by their names.
 	functions map[string]availableFunc
+	// slots maps the name of every identifier in the formula to the index of the slot holding its value
+	// during evaluation.
+	slots map[string]int
+	// limits holds the limits checked while parsing the formula and the maximum number of operations
+	// performed while evaluating it.
+	limits limits
+	// strict specifies if the formula is evaluated in strict math mode, as enabled using WithStrictMath.
+	strict bool
+}
+
+// evaluator is a function produced by the astParser that evaluates (part of) a formula using the state
+// passed.
+type evaluator func(s *state) (float64, error)
+
+// state holds the state of a single evaluation of a formula.
+type state struct {
+	// values holds the values of the variables and constants available during the evaluation, indexed by
+	// the slots of their names.
+	values []float64
+	// known specifies for every slot in values if a value was set for it.
+	known []bool
+	// folded specifies for every slot if it holds a constant folded into the program evaluated. exact is
+	// set once one of these is over-ridden, so that the formula is evaluated without folded constants.
+	folded []bool
+	exact  bool
+	// resolver is used to look up the values of variables that are not known, or nil if there is none.
+	resolver VariableResolver
+	// ctx is the context passed to EvalContext, or nil if the formula is evaluated without a context.
+	ctx context.Context
+	// done is the channel returned by ctx.Done(). It is nil if ctx is nil or can never be canceled.
+	done <-chan struct{}
+	// lazy holds the functions computing the values of lazy variables, indexed by the slots of their names.
+	// It is empty if no lazy variables were passed.
+	lazy []func() (float64, error)
+	// args is a stack holding the arguments of function calls. It is shared by all calls, so that no slice
+	// needs to be allocated for every call.
+	args []float64
+	// call is the call of the function currently being executed, or nil if no function is executed.
+	call *Call
+	// ops is the number of operations performed so far. It is only counted if the formula has a maximum
+	// number of operations.
+	ops int
 }
 
+// statePool holds states that may be reused for evaluations of formulas.
+var statePool = sync.Pool{New: func() interface{} {
+	return &state{args: make([]float64, 0, 16)}
+}}
+
 // availableFunc represents a function that was made available to the function to use.
 type availableFunc struct {
 	// function is the function that is called when the formula calls the function.
 	function func(args ...float64) float64
+	// contextFunction is called instead of function if the function was registered using
+	// RegisterFuncContext or RegisterFuncE. It receives the context passed to EvalContext and may return an
+	// error, which is returned as ErrFunc.
+	contextFunction func(ctx context.Context, args ...float64) (float64, error)
 	// paramCount is the minimum parameter count that must be passed to this function. If the amount of
 	// parameters passed is lower than paramCount, the function above is not called.
 	paramCount int
+	// maxParamCount is the maximum parameter count that may be passed to this function, or Variadic if
+	// there is no maximum. If the amount of parameters passed is higher than maxParamCount, the function
+	// above is not called.
+	maxParamCount int
+	// pure specifies if the function always returns the same result for the same arguments and has no side
+	// effects. Calls to pure functions with constant arguments are folded when the formula is compiled.
+	pure bool
+	// description and params hold the description and parameter names of the function, as set using
+	// Describe.
+	description string
+	params      []string
 }
 
-// parse parses the formula in the astParser into a function that may be executed by passing a vars map into
-// it. If the parsing was not successful, an error is returned.
-func (p *astParser) parse() (eval func(vars vars) (float64, error), err error) {
-	expr, err := parser.ParseExpr(p.formula)
+// parse parses the formula in the astParser into an AST. If the parsing was not successful, an error is
+// returned.
+func (p *astParser) parse() (Node, error) {
+	root, err := parseFormulaLimits(p.formula, p.limits)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing expression: %v", err)
+		return nil, xerrors.Errorf("error parsing expression: %w", err)
+	}
+	return root, nil
+}
+
+// newState returns a state from the statePool holding the initial values of the slots of the program passed.
+func newState(prog *program) *state {
+	s := statePool.Get().(*state)
+	if cap(s.values) < len(prog.values) {
+		s.values, s.known = make([]float64, len(prog.values)), make([]bool, len(prog.values))
+	}
+	s.values, s.known = s.values[:len(prog.values)], s.known[:len(prog.values)]
+	copy(s.values, prog.values)
+	copy(s.known, prog.known)
+	s.folded = prog.folded
+	return s
+}
+
+// context returns the context of the evaluation, or context.Background() if the formula is evaluated without
+// a context.
+func (s *state) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// interrupted checks if the context of the evaluation was canceled. If so, ErrCanceled is returned with the
+// position passed.
+func (s *state) interrupted(pos int) error {
+	select {
+	case <-s.done:
+		return &ErrCanceled{Pos: pos, Err: s.ctx.Err()}
+	default:
+		return nil
+	}
+}
+
+// count counts an operation performed for the node at the position passed. If more than max operations were
+// performed, ErrOpBudgetExceeded is returned.
+func (s *state) count(pos, max int) error {
+	s.ops++
+	if s.ops > max {
+		return &ErrOpBudgetExceeded{Pos: pos, Max: max}
+	}
+	return nil
+}
+
+// set sets the value of the slot passed to the value of the variable passed. For lazy variables, the value is
+// only computed once it is needed.
+func (s *state) set(slot int, variable Variable) {
+	if variable.lazy == nil {
+		s.setValue(slot, variable.value)
+		return
+	}
+	s.exact = s.exact || s.folded[slot]
+	if len(s.lazy) < len(s.values) {
+		if cap(s.lazy) < len(s.values) {
+			s.lazy = make([]func() (float64, error), len(s.values))
+		}
+		s.lazy = s.lazy[:len(s.values)]
+	}
+	s.lazy[slot], s.known[slot] = variable.lazy, false
+}
+
+// setValue sets the value of the slot passed.
+func (s *state) setValue(slot int, value float64) {
+	s.values[slot], s.known[slot] = value, true
+	s.exact = s.exact || s.folded[slot]
+}
+
+// run runs the evaluator passed using the state and returns the state to the statePool. If a registered
+// function panics, the panic is recovered and returned as ErrPanic.
+func (s *state) run(eval evaluator) (_ float64, rerr error) {
+	defer func() {
+		for i := range s.lazy {
+			s.lazy[i] = nil
+		}
+		s.args, s.call, s.resolver, s.lazy, s.ctx, s.done, s.ops = s.args[:0], nil, nil, s.lazy[:0], nil, nil, 0
+		s.folded, s.exact = nil, false
+		statePool.Put(s)
+	}()
+	// Catch panics within a registered function. This is done once for the whole evaluation, as deferring
+	// for every call is relatively expensive.
+	defer func() {
+		if r := recover(); r != nil {
+			rerr = panicError(s.call, r)
+		}
+	}()
+	return eval(s)
+}
+
+// panicError returns an ErrPanic for the value r recovered from a panic in the registered function called by
+// the call passed. It must be called directly by the deferred function that recovered r. If call is nil, the
+// panic did not originate from a registered function and r is panicked with again.
+func panicError(call *Call, r interface{}) error {
+	if call == nil {
+		panic(r)
+	}
+	_, f, line, _ := runtime.Caller(4)
+	return &ErrPanic{
+		Func:   call.Name,
+		Pos:    call.NamePos,
+		Reason: strings.TrimPrefix(fmt.Sprintf("%v", r), "runtime error: "),
+		File:   f,
+		Line:   line,
 	}
-	return p.parseExpr(expr)
 }
 
 // parseExpr parses the expression passed by checking what type it is and applying the correct parser. An
 // error is returned if the expression parsed returned one or if the expression was not one of the allowed
 // types.
-func (p *astParser) parseExpr(e ast.Expr) (eval func(vars vars) (float64, error), err error) {
+func (p *astParser) parseExpr(e Node) (eval evaluator, err error) {
 	switch expr := e.(type) {
-	case *ast.BasicLit:
-		eval, err = p.parseBasicLit(expr)
-	case *ast.Ident:
+	case *Number:
+		eval, err = p.parseNumber(expr)
+	case *Ident:
 		eval, err = p.parseIdent(expr)
-	case *ast.BinaryExpr:
+	case *Binary:
 		eval, err = p.parseBinaryExpr(expr)
-	case *ast.ParenExpr:
-		eval, err = p.parseParenExpr(expr)
-	case *ast.CallExpr:
+	case *Unary:
+		eval, err = p.parseUnaryExpr(expr)
+	case *Call:
 		eval, err = p.parseCallExpr(expr)
 	default:
-		return nil, fmt.Errorf("cannot parse unknown expression %v", reflect.TypeOf(e).Elem().String())
+		return nil, fmt.Errorf("cannot parse unknown expression %T", e)
+	}
+	if err == nil && p.strict {
+		eval = checkedFinite(eval, e)
+	}
+	if err == nil && p.limits.maxOps > 0 {
+		// Count the node as an operation before evaluating it, so that its operands are counted after it.
+		eval = countOps(eval, e.Pos(), p.limits.maxOps)
 	}
 	return
 }
 
+// countOps returns an evaluator that counts an operation for the node at the position passed before calling
+// eval. If more than max operations were performed, ErrOpBudgetExceeded is returned instead.
+func countOps(eval evaluator, pos, max int) evaluator {
+	return func(s *state) (float64, error) {
+		if err := s.count(pos, max); err != nil {
+			return math.NaN(), err
+		}
+		return eval(s)
+	}
+}
+
 // parseBinaryExpr parses a binary expression. This is an expression that has an operator in it to add,
-// subtract, multiply etc. Each binary expression only has one operator and 2 expressions. The AST package
+// subtract, multiply etc. Each binary expression only has one operator and 2 expressions. parseFormula
 // splits the formula up correctly itself.
-func (p *astParser) parseBinaryExpr(expr *ast.BinaryExpr) (eval func(vars vars) (float64, error), err error) {
+// Comparison (==, !=, <, <=, >, >=) and logical (&&, ||) operators result in 1 if true and 0 if false. Any
+// value other than 0 is considered true by the logical operators, which only evaluate Y if needed.
+func (p *astParser) parseBinaryExpr(expr *Binary) (eval evaluator, err error) {
 	x, err := p.parseExpr(expr.X)
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse binary expression X: %v", err)
@@ -74,180 +261,495 @@ func (p *astParser) parseBinaryExpr(expr *ast.BinaryExpr) (eval func(vars vars)
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse binary expression Y: %v", err)
 	}
+	if p.strict && (expr.Op == OpQuo || expr.Op == OpRem) {
+		y = checkedDivisor(y, expr.OpPos)
+	}
 
 	switch expr.Op {
-	case token.ADD:
-		eval = func(vars vars) (float64, error) {
-			x, err := x(vars)
+	case OpAdd:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
 			if err != nil {
 				return x, err
 			}
-			y, err := y(vars)
+			y, err := y(s)
 			if err != nil {
 				return y, err
 			}
 			return x + y, nil
 		}
-	case token.SUB:
-		eval = func(vars vars) (float64, error) {
-			x, err := x(vars)
+	case OpSub:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
 			if err != nil {
 				return x, err
 			}
-			y, err := y(vars)
+			y, err := y(s)
 			if err != nil {
 				return y, err
 			}
 			return x - y, nil
 		}
-	case token.MUL:
-		eval = func(vars vars) (float64, error) {
-			x, err := x(vars)
+	case OpMul:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
 			if err != nil {
 				return x, err
 			}
-			y, err := y(vars)
+			y, err := y(s)
 			if err != nil {
 				return y, err
 			}
 			return x * y, nil
 		}
-	case token.QUO:
-		eval = func(vars vars) (float64, error) {
-			x, err := x(vars)
+	case OpQuo:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
 			if err != nil {
 				return x, err
 			}
-			y, err := y(vars)
+			y, err := y(s)
 			if err != nil {
 				return y, err
 			}
 			return x / y, nil
 		}
-	case token.REM:
-		eval = func(vars vars) (float64, error) {
-			x, err := x(vars)
+	case OpRem:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
 			if err != nil {
 				return x, err
 			}
-			y, err := y(vars)
+			y, err := y(s)
 			if err != nil {
 				return y, err
 			}
 			return math.Mod(x, y), nil
 		}
+	case OpPow:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			y, err := y(s)
+			if err != nil {
+				return y, err
+			}
+			return math.Pow(x, y), nil
+		}
+	case OpEql:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			y, err := y(s)
+			if err != nil {
+				return y, err
+			}
+			return boolToFloat64(x == y), nil
+		}
+	case OpNeq:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			y, err := y(s)
+			if err != nil {
+				return y, err
+			}
+			return boolToFloat64(x != y), nil
+		}
+	case OpLss:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			y, err := y(s)
+			if err != nil {
+				return y, err
+			}
+			return boolToFloat64(x < y), nil
+		}
+	case OpLeq:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			y, err := y(s)
+			if err != nil {
+				return y, err
+			}
+			return boolToFloat64(x <= y), nil
+		}
+	case OpGtr:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			y, err := y(s)
+			if err != nil {
+				return y, err
+			}
+			return boolToFloat64(x > y), nil
+		}
+	case OpGeq:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			y, err := y(s)
+			if err != nil {
+				return y, err
+			}
+			return boolToFloat64(x >= y), nil
+		}
+	case OpLAnd:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			if x == 0 {
+				// Short-circuit: Y is never evaluated if X is false.
+				return 0, nil
+			}
+			y, err := y(s)
+			if err != nil {
+				return y, err
+			}
+			return boolToFloat64(y != 0), nil
+		}
+	case OpLOr:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			if x != 0 {
+				// Short-circuit: Y is never evaluated if X is true.
+				return 1, nil
+			}
+			y, err := y(s)
+			if err != nil {
+				return y, err
+			}
+			return boolToFloat64(y != 0), nil
+		}
 	default:
-		return nil, fmt.Errorf("unknown mathematical operation '%v'", expr.Op)
+		return nil, fmt.Errorf("unknown mathematical operation '%v' (pos:%d)", expr.Op, expr.OpPos)
 	}
 	return
 }
 
-// parseBasicLit parses a basic literal, provided the literal is a numeric one, like a float or an integer.
-// Both integers and floats are parsed as a float64.
-func (p *astParser) parseBasicLit(lit *ast.BasicLit) (func(vars vars) (float64, error), error) {
-	switch lit.Kind {
-	case token.INT:
-		val, err := strconv.Atoi(lit.Value)
-		if err != nil {
-			return nil, fmt.Errorf("invalid value for token.INT %v: %v", lit.Value, err)
+// parseUnaryExpr parses a unary expression. This is an expression with an operator in front of a single
+// expression, such as a negation. The operators supported are -, +, ! (logical not, resulting in 1 if the
+// expression is 0 and 0 otherwise), ^ (bitwise complement of the expression as an integer) and the postfix
+// ! (factorial, which is extended to non-integers using the gamma function).
+func (p *astParser) parseUnaryExpr(expr *Unary) (eval evaluator, err error) {
+	x, err := p.parseExpr(expr.X)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse unary expression X: %v", err)
+	}
+
+	switch expr.Op {
+	case OpSub:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			return -x, nil
 		}
-		value := float64(val)
-		return wrapFunc(value), nil
-	case token.FLOAT:
-		val, err := strconv.ParseFloat(lit.Value, 64)
-		if err != nil {
-			return nil, fmt.Errorf("invalid value for token.FLOAT %v: %v", lit.Value, err)
+	case OpAdd:
+		eval = x
+	case OpNot:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			if x == 0 {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case OpBitNot:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			return float64(^int64(x)), nil
+		}
+	case OpFactorial:
+		eval = func(s *state) (float64, error) {
+			x, err := x(s)
+			if err != nil {
+				return x, err
+			}
+			return math.Gamma(x + 1), nil
 		}
-		return wrapFunc(val), nil
 	default:
-		return nil, fmt.Errorf("literal must be of type token.INT or token.FLOAT, got %v", lit.Kind)
+		return nil, fmt.Errorf("unknown unary operation '%v' (pos:%d)", expr.Op, expr.OpPos)
 	}
+	return
 }
 
-// parseIdent parses an identifier. (generally a variable that needs to be substituted with what is found in
-// the vars map passed)
-func (p *astParser) parseIdent(ident *ast.Ident) (func(vars vars) (float64, error), error) {
-	return func(vars vars) (float64, error) {
-		name := ident.Name
-		value, ok := vars[name]
-		if !ok {
-			err := &ErrUnknownVariable{
-				Var: name,
-				Pos: int(ident.NamePos) - 1,
-			}
-			return math.NaN(), err
+// parseNumber parses a numeric literal. Its value is already known, so the function returned simply returns
+// it.
+func (p *astParser) parseNumber(n *Number) (evaluator, error) {
+	return wrapFunc(n.Value), nil
+}
+
+// parseIdent parses an identifier. (generally a variable that needs to be substituted with the value in its
+// slot)
+func (p *astParser) parseIdent(ident *Ident) (evaluator, error) {
+	slot := p.slots[ident.Name]
+	return func(s *state) (float64, error) {
+		if !s.known[slot] {
+			return s.resolve(ident, slot)
 		}
-		return value, nil
+		return s.values[slot], nil
 	}, nil
 }
 
-// parseParenExpr parses an expression within parentheses and returns the function returned by the expression
-// within those parentheses.
-func (p *astParser) parseParenExpr(expr *ast.ParenExpr) (func(vars vars) (float64, error), error) {
-	return p.parseExpr(expr.X)
+// resolve looks up the value of a variable of which the value is not yet known, by calling the function of a
+// lazy variable or using the VariableResolver of the state. The value is stored in the slot passed, so that it
+// is only looked up once during an evaluation. If no value is found, ErrUnknownVariable is returned.
+func (s *state) resolve(ident *Ident, slot int) (float64, error) {
+	if slot < len(s.lazy) && s.lazy[slot] != nil {
+		if s.done != nil {
+			if err := s.interrupted(ident.NamePos); err != nil {
+				return math.NaN(), err
+			}
+		}
+		value, err := s.lazy[slot]()
+		if err != nil {
+			return math.NaN(), &ErrVariable{Var: ident.Name, Pos: ident.NamePos, Err: err}
+		}
+		s.values[slot], s.known[slot] = value, true
+		return value, nil
+	}
+	if s.resolver != nil {
+		if value, ok := s.resolver.Resolve(ident.Name); ok {
+			s.values[slot], s.known[slot] = value, true
+			return value, nil
+		}
+	}
+	err := &ErrUnknownVariable{
+		Var: ident.Name,
+		Pos: ident.NamePos,
+	}
+	return math.NaN(), err
 }
 
 // parseCallExpr parses a call expression. It parses all parameters inside of the function and evaluates them
-// when the function is evaluated.
-func (p *astParser) parseCallExpr(expr *ast.CallExpr) (func(vars vars) (float64, error), error) {
-	args := make([]func(vars vars) (float64, error), len(expr.Args))
-	for i, arg := range expr.Args {
-		f, err := p.parseExpr(arg)
-		if err != nil {
-			return nil, fmt.Errorf("error parsing function parameter: %v", err)
-		}
-		args[i] = f
+// when the function is evaluated. The function called is looked up immediately: If it is unknown or passed
+// an invalid number of arguments, the evaluator returned always returns the corresponding error.
+func (p *astParser) parseCallExpr(expr *Call) (evaluator, error) {
+	switch expr.Name {
+	case "if":
+		return p.parseIf(expr)
+	case "ifs":
+		return p.parseIfs(expr)
 	}
-	return func(vars vars) (_ float64, rerr error) {
-		funcName := expr.Fun.(*ast.Ident).Name
-		// Catch panics within a registered function.
-		defer func() {
-			if r := recover(); r != nil {
-				_, f, line, _ := runtime.Caller(3)
-				err := &ErrPanic{
-					Func:   funcName,
-					Pos:    int(expr.Lparen) - len(funcName) - 1,
-					Reason: strings.TrimPrefix(fmt.Sprintf("%v", r), "runtime error: "),
-					File:   f,
-					Line:   line,
-				}
-				rerr = err
-			}
-		}()
-
-		f, ok := p.functions[funcName]
-		if !ok {
-			err := &ErrUnknownFunc{
-				Func: funcName,
-				Pos:  int(expr.Lparen) - len(funcName) - 1,
-			}
+	args, err := p.parseArgs(expr)
+	if err != nil {
+		return nil, err
+	}
+	f, err := p.function(expr)
+	if err != nil {
+		return func(s *state) (float64, error) {
 			return math.NaN(), err
+		}, nil
+	}
+	function, contextFunction := f.function, f.contextFunction
+	return func(s *state) (_ float64, err error) {
+		start := len(s.args)
+		for _, arg := range args {
+			av, err := arg(s)
+			if err != nil {
+				s.args = s.args[:start]
+				return av, err
+			}
+			s.args = append(s.args, av)
 		}
-		if len(expr.Args) < f.paramCount {
-			// Too few arguments supplied to the function.
-			err := &ErrInsufficientArgs{
-				Func:     funcName,
-				Pos:      int(expr.Lparen) - len(funcName) - 1,
-				Actual:   len(expr.Args),
-				Expected: f.paramCount,
+		if s.done != nil {
+			if err := s.interrupted(expr.NamePos); err != nil {
+				s.args = s.args[:start]
+				return math.NaN(), err
 			}
-			return math.NaN(), err
 		}
-		argValues := make([]float64, len(expr.Args))
-		for i, argValue := range args {
-			av, err := argValue(vars)
+		parent := s.call
+		s.call = expr
+		var v float64
+		if contextFunction != nil {
+			v, err = contextFunction(s.context(), s.args[start:]...)
+		} else {
+			v = function(s.args[start:]...)
+		}
+		s.call = parent
+		s.args = s.args[:start]
+		if err != nil {
+			return math.NaN(), &ErrFunc{Func: expr.Name, Pos: expr.NamePos, Err: err}
+		}
+		return v, nil
+	}, nil
+}
+
+// withContext returns a function that may be used as contextFunction of an availableFunc, which calls the
+// function passed and never returns an error.
+func withContext(f func(ctx context.Context, args ...float64) float64) func(ctx context.Context, args ...float64) (float64, error) {
+	return func(ctx context.Context, args ...float64) (float64, error) {
+		return f(ctx, args...), nil
+	}
+}
+
+// withError returns a function that may be used as contextFunction of an availableFunc, which calls the
+// function passed without the context.
+func withError(f func(args ...float64) (float64, error)) func(ctx context.Context, args ...float64) (float64, error) {
+	return func(ctx context.Context, args ...float64) (float64, error) {
+		return f(args...)
+	}
+}
+
+// function looks up the function called by the call passed and checks if the number of arguments passed is
+// accepted by it. ErrUnknownFunc is returned if no function with the name called was registered. If too few
+// or too many arguments were passed, ErrInsufficientArgs or ErrTooManyArgs is returned respectively.
+func (p *astParser) function(call *Call) (availableFunc, error) {
+	f, ok := p.functions[call.Name]
+	if !ok {
+		return f, &ErrUnknownFunc{
+			Func: call.Name,
+			Pos:  call.NamePos,
+		}
+	}
+	if len(call.Args) < f.paramCount {
+		// Too few arguments supplied to the function.
+		return f, &ErrInsufficientArgs{
+			Func:     call.Name,
+			Pos:      call.NamePos,
+			Actual:   len(call.Args),
+			Expected: f.paramCount,
+		}
+	}
+	if f.maxParamCount != Variadic && len(call.Args) > f.maxParamCount {
+		// Too many arguments supplied to the function.
+		return f, &ErrTooManyArgs{
+			Func:     call.Name,
+			Pos:      call.NamePos,
+			Actual:   len(call.Args),
+			Expected: f.maxParamCount,
+		}
+	}
+	return f, nil
+}
+
+// parseIf parses a call to the built-in if(cond, a, b). Unlike registered functions, which receive the values
+// of all of their arguments, only the branch selected by cond is evaluated: a if cond is not 0 and b if it
+// is.
+func (p *astParser) parseIf(expr *Call) (evaluator, error) {
+	if err := checkConditional(expr); err != nil {
+		return nil, err
+	}
+	args, err := p.parseArgs(expr)
+	if err != nil {
+		return nil, err
+	}
+	cond, a, b := args[0], args[1], args[2]
+	return func(s *state) (float64, error) {
+		c, err := cond(s)
+		if err != nil {
+			return c, err
+		}
+		if c != 0 {
+			return a(s)
+		}
+		return b(s)
+	}, nil
+}
+
+// parseIfs parses a call to the built-in ifs(cond1, a1, cond2, a2, ..., b). The conditions are evaluated in
+// order and the value following the first condition that is not 0 is returned. If none of the conditions
+// are met, b is returned. Only the conditions up to the one met and the value selected are evaluated.
+func (p *astParser) parseIfs(expr *Call) (evaluator, error) {
+	if err := checkConditional(expr); err != nil {
+		return nil, err
+	}
+	args, err := p.parseArgs(expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(s *state) (float64, error) {
+		for i := 0; i < len(args)-1; i += 2 {
+			c, err := args[i](s)
 			if err != nil {
-				return av, err
+				return c, err
+			}
+			if c != 0 {
+				return args[i+1](s)
 			}
-			argValues[i] = av
 		}
-		return f.function(argValues...), nil
+		return args[len(args)-1](s)
 	}, nil
 }
 
+// checkConditional checks if the number of arguments passed to a call to if or ifs is valid. if requires
+// exactly 3 arguments, ifs requires an odd number of at least 3 arguments.
+func checkConditional(expr *Call) error {
+	switch {
+	case expr.Name == "if" && len(expr.Args) != 3:
+		return fmt.Errorf("if requires exactly 3 arguments, got %v (pos:%d)", len(expr.Args), expr.NamePos)
+	case expr.Name == "ifs" && (len(expr.Args) < 3 || len(expr.Args)%2 == 0):
+		return fmt.Errorf("ifs requires pairs of conditions and values followed by a default value, got %v arguments (pos:%d)", len(expr.Args), expr.NamePos)
+	}
+	return nil
+}
+
+// parseArgs parses all arguments of the call expression passed.
+func (p *astParser) parseArgs(expr *Call) ([]evaluator, error) {
+	args := make([]evaluator, len(expr.Args))
+	for i, arg := range expr.Args {
+		f, err := p.parseExpr(arg)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing function parameter: %v", err)
+		}
+		args[i] = f
+	}
+	return args, nil
+}
+
+// sortedKeys returns the keys of the map passed, sorted in increasing order. If filter is not nil, only the
+// keys for which filter returns true are returned.
+func sortedKeys(m map[string]struct{}, filter func(key string) bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		if filter == nil || filter(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// boolToFloat64 converts a boolean to a float64: 1 if b is true and 0 if b is false.
+func boolToFloat64(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 // wrapFunc returns a function that wraps around the value passed and returns it.
-func wrapFunc(value float64) func(vars vars) (float64, error) {
-	return func(vars vars) (float64, error) {
+func wrapFunc(value float64) evaluator {
+	return func(s *state) (float64, error) {
 		return value, nil
 	}
 }
@@ -2,4 +2,4 @@
 
 package formula
 
-func (formula *Formula) registerExtra() {}
+func (env *Environment) registerExtra() {}
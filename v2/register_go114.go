@@ -2,6 +2,6 @@
 
 package formula
 
-func (formula *Formula) registerExtra() {
-	formula.RegisterFunc("fma", 3, fma)
+func (env *Environment) registerExtra() {
+	env.RegisterFuncRange("fma", 3, 3, fma)
 }
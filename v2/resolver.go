@@ -0,0 +1,58 @@
+package formula
+
+// VariableResolver looks up the values of variables in a formula. It may be passed to Formula.EvalResolver to
+// evaluate a formula with variables that are only looked up once they are needed.
+type VariableResolver interface {
+	// Resolve returns the value of the variable with the name passed. If the variable does not exist, false
+	// is returned.
+	Resolve(name string) (float64, bool)
+}
+
+// ResolverFunc is a function that implements VariableResolver.
+//
+// Example:
+//
+//  v, err := f.EvalResolver(formula.ResolverFunc(func(name string) (float64, bool) {
+//     value, err := strconv.ParseFloat(os.Getenv(name), 64)
+//     return value, err == nil
+//  }))
+//
+type ResolverFunc func(name string) (float64, bool)
+
+// Resolve calls f(name).
+func (f ResolverFunc) Resolve(name string) (float64, bool) {
+	return f(name)
+}
+
+// EvalMap evaluates the formula using the variables in the map passed, indexed by their names. It works like
+// Eval, but does not require the map to be converted into variables first. Only the variables used by the
+// formula are looked up in the map.
+func (formula *Formula) EvalMap(variables map[string]float64) (float64, error) {
+	prog := formula.compiled()
+	s := newState(prog)
+	for slot, name := range formula.names {
+		if value, ok := variables[name]; ok {
+			s.setValue(slot, value)
+		}
+	}
+	return formula.run(prog, s)
+}
+
+// EvalResolver evaluates the formula using the VariableResolver passed to look up variables. A variable is
+// only resolved once it is evaluated, so that variables in a value not selected by if, for example, are
+// never looked up. Every variable is resolved at most once per evaluation. Names of constants, such as pi,
+// are resolved before evaluating, as they may be over-ridden by the resolver.
+func (formula *Formula) EvalResolver(resolver VariableResolver) (float64, error) {
+	prog := formula.compiled()
+	s := newState(prog)
+	for slot, name := range formula.names {
+		if !prog.known[slot] {
+			continue
+		}
+		if value, ok := resolver.Resolve(name); ok {
+			s.setValue(slot, value)
+		}
+	}
+	s.resolver = resolver
+	return formula.run(prog, s)
+}
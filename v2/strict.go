@@ -0,0 +1,55 @@
+package formula
+
+import (
+	"math"
+)
+
+// checkFinite checks if the value passed, which is the result of the node passed, is finite. If the value is
+// NaN and the node is a call or operator, ErrDomain is returned, as its operands are finite in strict
+// formulas. For other values that are not finite, ErrNonFinite is returned.
+func checkFinite(n Node, value float64) error {
+	if !math.IsNaN(value) && !math.IsInf(value, 0) {
+		return nil
+	}
+	if math.IsNaN(value) {
+		switch n := n.(type) {
+		case *Call:
+			return &ErrDomain{Func: n.Name, Pos: n.NamePos}
+		case *Unary:
+			return &ErrDomain{Func: n.Op.String(), Pos: n.OpPos}
+		case *Binary:
+			return &ErrDomain{Func: n.Op.String(), Pos: n.OpPos}
+		}
+	}
+	return &ErrNonFinite{Value: value, Pos: n.Pos()}
+}
+
+// checkedFinite returns an evaluator that calls eval and checks if the result of the node passed is finite
+// using checkFinite.
+func checkedFinite(eval evaluator, n Node) evaluator {
+	return func(s *state) (float64, error) {
+		v, err := eval(s)
+		if err != nil {
+			return v, err
+		}
+		if err := checkFinite(n, v); err != nil {
+			return math.NaN(), err
+		}
+		return v, nil
+	}
+}
+
+// checkedDivisor returns an evaluator that calls the evaluator of the divisor passed and returns
+// ErrDivisionByZero with the position passed if it results in 0.
+func checkedDivisor(y evaluator, pos int) evaluator {
+	return func(s *state) (float64, error) {
+		v, err := y(s)
+		if err != nil {
+			return v, err
+		}
+		if v == 0 {
+			return math.NaN(), &ErrDivisionByZero{Pos: pos}
+		}
+		return v, nil
+	}
+}
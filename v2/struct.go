@@ -0,0 +1,188 @@
+package formula
+
+import (
+	"reflect"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// structField is a field of a struct that may be used as variable in a formula.
+type structField struct {
+	// name is the name of the variable the field holds the value of.
+	name string
+	// index is the index sequence of the field, as used by reflect.Value.FieldByIndex.
+	index []int
+}
+
+// structPlan is the list of fields of a struct type that may be used as variables, or the error found while
+// creating it.
+type structPlan struct {
+	fields []structField
+	err    error
+}
+
+// structPlans holds the *structPlan of every struct type that was passed to Formula.EvalStruct, indexed by the
+// reflect.Type of the struct.
+var structPlans sync.Map
+
+// fieldSlot is a structField that is used by a formula, along with the slot of its variable in the formula.
+type fieldSlot struct {
+	index []int
+	slot  int
+}
+
+// EvalStruct evaluates the formula using the fields of the struct, or pointer to a struct, passed as
+// variables. Exported fields of numeric and bool types are used, bools being 1 if true and 0 if false and
+// fields of type time.Duration being their number of seconds. The name of the variable of a field is the
+// name of the field, unless the field has a formula tag:
+//
+//  type Order struct {
+//     Price    float64 `formula:"price"`
+//     Quantity int     `formula:"qty"`
+//     Internal float64 `formula:"-"`
+//     Customer struct {
+//        Discount float64 `formula:"discount"`
+//     } `formula:"customer"`
+//  }
+//
+// Fields with the tag "-" are ignored. The fields of nested structs are available with the name of the
+// struct field as prefix, so that the formula may use price * qty * (1 - customer.discount). The fields of
+// embedded structs without a tag are available as if they were fields of the struct itself. Fields of nil
+// pointers are not set.
+//
+// The fields used by the formula are looked up once for every struct type, so that evaluating the formula
+// for many values of the same type is cheap. An error is returned if v is not a struct or pointer to a struct,
+// or if a field with a formula tag does not have a type that may be used as variable.
+func (formula *Formula) EvalStruct(v interface{}) (float64, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return 0, xerrors.Errorf("expected struct or pointer to struct, got %T", v)
+	}
+	fields, err := formula.structFields(rv.Type())
+	if err != nil {
+		return 0, err
+	}
+
+	prog := formula.compiled()
+	s := newState(prog)
+	for _, field := range fields {
+		if value, ok := fieldValue(rv, field.index); ok {
+			s.setValue(field.slot, value)
+		}
+	}
+	return formula.run(prog, s)
+}
+
+// structFields returns the fields of the struct type passed that are used by the formula. The fields are
+// cached, so that they are only looked up once for every type.
+func (formula *Formula) structFields(t reflect.Type) ([]fieldSlot, error) {
+	if fields, ok := formula.structs.Load(t); ok {
+		return fields.([]fieldSlot), nil
+	}
+	plan := planStruct(t)
+	if plan.err != nil {
+		return nil, plan.err
+	}
+	var fields []fieldSlot
+	for _, field := range plan.fields {
+		if slot, ok := formula.slots[field.name]; ok {
+			fields = append(fields, fieldSlot{index: field.index, slot: slot})
+		}
+	}
+	formula.structs.Store(t, fields)
+	return fields, nil
+}
+
+// planStruct returns the structPlan of the struct type passed, creating it if it does not yet exist.
+func planStruct(t reflect.Type) *structPlan {
+	if plan, ok := structPlans.Load(t); ok {
+		return plan.(*structPlan)
+	}
+	plan := &structPlan{}
+	plan.err = plan.add(t, "", nil, map[reflect.Type]bool{t: true})
+	structPlans.Store(t, plan)
+	return plan
+}
+
+// add adds the fields of the struct type passed to the plan. The names of the fields are prefixed with prefix
+// and their index sequences with index. parents holds the struct types that t is nested in, so that recursive
+// types do not cause infinite recursion.
+func (plan *structPlan) add(t reflect.Type, prefix string, index []int, parents map[reflect.Type]bool) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, tagged := f.Tag.Lookup("formula")
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			// Ignored or unexported field.
+			continue
+		}
+		name := f.Name
+		if tag != "" {
+			name = tag
+		}
+		fieldIndex := append(index[:len(index):len(index)], i)
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch {
+		case isNumeric(ft):
+			if f.PkgPath == "" {
+				plan.addField(structField{name: prefix + name, index: fieldIndex})
+			}
+		case ft.Kind() == reflect.Struct:
+			if parents[ft] {
+				continue
+			}
+			nestedPrefix := prefix + name + "."
+			if f.Anonymous && !tagged {
+				nestedPrefix = prefix
+			}
+			parents[ft] = true
+			err := plan.add(ft, nestedPrefix, fieldIndex, parents)
+			delete(parents, ft)
+			if err != nil {
+				return err
+			}
+		default:
+			if tagged {
+				return xerrors.Errorf("field %v of %v with type %v cannot be used as variable", f.Name, t, f.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// addField adds the field passed to the plan, unless a field with the same name was already added.
+func (plan *structPlan) addField(field structField) {
+	for _, existing := range plan.fields {
+		if existing.name == field.name {
+			return
+		}
+	}
+	plan.fields = append(plan.fields, field)
+}
+
+// fieldValue returns the value of the field with the index sequence passed in the struct value v as float64.
+// If the field is in a struct pointed to by a nil pointer, or is a nil pointer itself, false is returned.
+func fieldValue(v reflect.Value, index []int) (float64, bool) {
+	for _, i := range index {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return 0, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return 0, false
+		}
+		v = v.Elem()
+	}
+	return numericValue(v)
+}
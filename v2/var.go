@@ -1,54 +1,148 @@
 package formula
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Variable represents a variable with a specific name and value, that may be passed to a formula.
 type Variable struct {
 	name  string
 	value float64
+	// lazy is the function computing the value of the variable, or nil if the value is known.
+	lazy func() (float64, error)
 }
 
 // Var returns a new variable that may be passed to a formula when evaluating it. All variables in the formula
-// with that name will then adapt the value of the variable. The value passed must be a numeric value. If the
-// value is not numeric, the function panics.
+// with that name will then adapt the value of the variable. The value passed must be a numeric value, any of
+// the other values accepted by VarE or a func() (float64, error), in which case Var is equivalent to LazyVar.
+// If the value cannot be converted, the function panics. VarE may be used to get an error instead.
 func Var(name string, value interface{}) Variable {
-	return Variable{name: name, value: valueToFloat64(value)}
+	variable, err := VarE(name, value)
+	if err != nil {
+		panic(err)
+	}
+	return variable
+}
+
+// VarE returns a new variable like Var, but returns ErrInvalidValue instead of panicking if the value passed
+// cannot be converted to a float64. Besides the numeric types, the following values are accepted:
+//
+//  bool                    1 if true, 0 if false
+//  string, json.Number     parsed using strconv.ParseFloat, for example "1.5" or "1e3"
+//  *big.Int, *big.Float    the nearest float64 value
+//  *big.Rat                the nearest float64 value
+//  time.Duration           the duration in seconds, for example 1.5 for 1500 * time.Millisecond
+//  Float64() float64       the value returned by the method
+//
+// Types with one of the numeric types or bool as underlying type, such as type Celsius float64, are accepted
+// too.
+func VarE(name string, value interface{}) (Variable, error) {
+	if f, ok := value.(func() (float64, error)); ok {
+		return LazyVar(name, f), nil
+	}
+	v, err := valueToFloat64(value)
+	if err != nil {
+		return Variable{}, &ErrInvalidValue{Var: name, Value: value, Err: err}
+	}
+	return Variable{name: name, value: v}, nil
+}
+
+// LazyVar returns a new variable of which the value is computed by the function passed. The function is only
+// called once the variable is evaluated, so that it is not called at all if the variable is, for example,
+// only used in a value not selected by if. It is called at most once per evaluation. If the function returns
+// an error, the evaluation stops and ErrVariable is returned, wrapping the error.
+//
+// Example:
+//
+//  f.Eval(formula.Var("amount", 100), formula.LazyVar("rate", func() (float64, error) {
+//     return db.ExchangeRate("EUR")
+//  }))
+//
+func LazyVar(name string, f func() (float64, error)) Variable {
+	return Variable{name: name, lazy: f}
+}
+
+// float64er is implemented by types that may be converted to a float64.
+type float64er interface {
+	Float64() float64
 }
 
-// valueToFloat converts a numeric value to a float64 value. If the value passed was not numeric, the function
-// panics.
-func valueToFloat64(value interface{}) float64 {
+// valueToFloat64 converts a numeric value to a float64 value. If the value passed could not be converted, an
+// error is returned.
+func valueToFloat64(value interface{}) (float64, error) {
 	switch val := value.(type) {
 	case uint8:
-		return float64(val)
+		return float64(val), nil
 	case int8:
-		return float64(val)
+		return float64(val), nil
 	case uint16:
-		return float64(val)
+		return float64(val), nil
 	case int16:
-		return float64(val)
+		return float64(val), nil
 	case uint32:
-		return float64(val)
+		return float64(val), nil
 	case int32:
-		return float64(val)
+		return float64(val), nil
 	case uint64:
-		return float64(val)
+		return float64(val), nil
 	case int64:
-		return float64(val)
+		return float64(val), nil
 	case int:
-		return float64(val)
+		return float64(val), nil
 	case uint:
-		return float64(val)
+		return float64(val), nil
 	case float32:
-		return float64(val)
+		return float64(val), nil
 	case float64:
-		return val
-	default:
-		panic(fmt.Sprintf("invalid variable type %T, must be numeric", value))
+		return val, nil
+	case bool:
+		return boolToFloat64(val), nil
+	case time.Duration:
+		return val.Seconds(), nil
+	case json.Number:
+		return strconv.ParseFloat(string(val), 64)
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(val), 64)
+	case *big.Int:
+		if val == nil {
+			return 0, errors.New("nil *big.Int")
+		}
+		f, _ := new(big.Float).SetInt(val).Float64()
+		return f, nil
+	case *big.Float:
+		if val == nil {
+			return 0, errors.New("nil *big.Float")
+		}
+		f, _ := val.Float64()
+		return f, nil
+	case *big.Rat:
+		if val == nil {
+			return 0, errors.New("nil *big.Rat")
+		}
+		f, _ := val.Float64()
+		return f, nil
+	case float64er:
+		return val.Float64(), nil
 	}
-}
 
-// vars is a map of variables in a name => value map.
-type vars map[string]float64
+	// Types with a numeric underlying type, such as type Celsius float64.
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Bool:
+		return boolToFloat64(v.Bool()), nil
+	}
+	return 0, fmt.Errorf("invalid variable type %T, must be numeric", value)
+}
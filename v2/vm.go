@@ -0,0 +1,518 @@
+package formula
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// Backend is a backend used to evaluate formulas. It may be selected using WithBackend.
+type Backend int
+
+const (
+	// BackendClosure evaluates formulas by compiling them into a tree of nested functions. It is the default
+	// backend.
+	BackendClosure Backend = iota
+	// BackendVM evaluates formulas by compiling them into a flat list of instructions that is run by a small
+	// stack based virtual machine. It avoids the function call made for every node by BackendClosure, which
+	// makes it faster for large formulas, while BackendClosure is generally faster for small formulas.
+	BackendVM
+)
+
+// opcode is the operation performed by an instruction of the virtual machine.
+type opcode uint8
+
+const (
+	// vmConst pushes the constant with index arg onto the stack.
+	vmConst opcode = iota
+	// vmVar pushes the value of the variable in slot arg onto the stack. n is the index of the variable in
+	// the variables of the program.
+	vmVar
+	// vmCall pops n arguments from the stack, calls the function with index arg with them and pushes the
+	// result.
+	vmCall
+	// vmError stops execution and returns the error with index arg.
+	vmError
+	// vmJump continues execution at instruction arg.
+	vmJump
+	// vmJumpIfZero pops a value from the stack and continues execution at instruction arg if it is 0.
+	vmJumpIfZero
+	// vmJumpIfNotZero pops a value from the stack and continues execution at instruction arg if it is not 0.
+	vmJumpIfNotZero
+	// vmBool replaces the value on top of the stack with 1 if it is not 0.
+	vmBool
+
+	// vmCount counts the n operations starting at index arg of the positions of the program, stopping
+	// execution if the maximum number of operations is exceeded. It is only emitted if the program has a
+	// maximum number of operations.
+	vmCount
+	// vmCheck checks if the value on top of the stack, which is the result of the node with index arg, is
+	// finite. vmCheckDivisor checks if it is not 0, as it is the divisor of the node with index arg. They are
+	// only emitted in strict math mode.
+	vmCheck
+	vmCheckDivisor
+
+	// The unary operations replace the value on top of the stack with the result of the operation.
+	vmNeg
+	vmNot
+	vmBitNot
+	vmFactorial
+
+	// The binary operations replace the value on top of the stack, X, with the result of the operation. Y is
+	// popped from the stack, or is the constant or variable with index arg, depending on the operand of the
+	// instruction. All binary operations must follow vmAdd.
+	vmAdd
+	vmSub
+	vmMul
+	vmQuo
+	vmRem
+	vmPow
+	vmEql
+	vmNeq
+	vmLss
+	vmLeq
+	vmGtr
+	vmGeq
+)
+
+// operand specifies where the second operand of a binary operation is taken from.
+type operand uint8
+
+const (
+	// operandStack pops the operand from the stack.
+	operandStack operand = iota
+	// operandConst uses the constant with index arg.
+	operandConst
+	// operandVar uses the variable in slot arg. n is the index of the variable in the variables of the program.
+	operandVar
+)
+
+// vmBinaryOps maps every binary operator, except for the logical operators, to its opcode.
+var vmBinaryOps = map[Op]opcode{
+	OpAdd: vmAdd, OpSub: vmSub, OpMul: vmMul, OpQuo: vmQuo, OpRem: vmRem, OpPow: vmPow,
+	OpEql: vmEql, OpNeq: vmNeq, OpLss: vmLss, OpLeq: vmLeq, OpGtr: vmGtr, OpGeq: vmGeq,
+}
+
+// instruction is a single instruction run by the virtual machine.
+type instruction struct {
+	op opcode
+	// operand is where Y is taken from for binary operations.
+	operand operand
+	// n is the number of arguments passed for vmCall instructions.
+	n int32
+	// arg is the argument of the instruction. What it means depends on op.
+	arg int32
+}
+
+// vmFunc is a function called by a vmCall instruction.
+type vmFunc struct {
+	function        func(args ...float64) float64
+	contextFunction func(ctx context.Context, args ...float64) (float64, error)
+	// call is the call in the AST that the function was called from.
+	call *Call
+}
+
+// vmProgram is a formula compiled into instructions for the virtual machine.
+type vmProgram struct {
+	code      []instruction
+	constants []float64
+	// variables holds the identifiers of the variables used, so that they may be resolved if their values
+	// are not known.
+	variables []*Ident
+	functions []vmFunc
+	errs      []error
+	// positions holds the positions of the nodes counted by vmCount instructions and maxOps the maximum
+	// number of operations performed by a single run.
+	positions []int
+	maxOps    int
+	// nodes holds the nodes checked by vmCheck and vmCheckDivisor instructions.
+	nodes []Node
+	// stackSize is the maximum size of the stack while running the program.
+	stackSize int
+}
+
+// vmCompiler compiles the AST of a formula into a vmProgram.
+type vmCompiler struct {
+	// functions is a map of functions that may be executed by the formula, indexed by their names.
+	functions map[string]availableFunc
+	// slots maps the name of every identifier in the formula to the index of its slot.
+	slots map[string]int
+	// strict specifies if the formula is evaluated in strict math mode.
+	strict bool
+	prog   *vmProgram
+	// stack is the size of the stack at the current instruction.
+	stack int
+	// pending holds the positions of the nodes entered since the last instruction was emitted. They are
+	// counted by a vmCount instruction emitted before the next instruction.
+	pending []int
+}
+
+// compileVM compiles the AST passed into a program for the virtual machine and returns an evaluator that
+// runs it. The functions, slots, maximum number of operations and strict math mode of the astParser passed are
+// used. Operations are only counted and results only checked by instructions emitted for that purpose, so
+// that programs without limits do not pay for them.
+func compileVM(root Node, p *astParser) (evaluator, error) {
+	c := &vmCompiler{functions: p.functions, slots: p.slots, strict: p.strict, prog: &vmProgram{maxOps: p.limits.maxOps}}
+	if err := c.compile(root); err != nil {
+		return nil, err
+	}
+	return c.prog.run, nil
+}
+
+// emit adds an instruction to the program and returns its index. The stack size is changed by delta. If
+// nodes were entered since the last instruction, a vmCount instruction counting them is emitted first.
+func (c *vmCompiler) emit(op opcode, arg, n int, delta int) int {
+	if len(c.pending) != 0 {
+		c.prog.code = append(c.prog.code, instruction{op: vmCount, arg: int32(len(c.prog.positions)), n: int32(len(c.pending))})
+		c.prog.positions = append(c.prog.positions, c.pending...)
+		c.pending = c.pending[:0]
+	}
+	c.prog.code = append(c.prog.code, instruction{op: op, arg: int32(arg), n: int32(n)})
+	c.stack += delta
+	if c.stack > c.prog.stackSize {
+		c.prog.stackSize = c.stack
+	}
+	return len(c.prog.code) - 1
+}
+
+// enter marks the node at the position passed as entered, so that it is counted as an operation before the
+// next instruction if the program has a maximum number of operations.
+func (c *vmCompiler) enter(pos int) {
+	if c.prog.maxOps > 0 {
+		c.pending = append(c.pending, pos)
+	}
+}
+
+// check emits an instruction checking the result of the node passed to be finite in strict math mode.
+func (c *vmCompiler) check(n Node) {
+	if c.strict {
+		c.prog.nodes = append(c.prog.nodes, n)
+		c.emit(vmCheck, len(c.prog.nodes)-1, 0, 0)
+	}
+}
+
+// patch sets the target of the jump instruction at index i to the next instruction emitted.
+func (c *vmCompiler) patch(i int) {
+	c.prog.code[i].arg = int32(len(c.prog.code))
+}
+
+// constant emits an instruction pushing the value passed.
+func (c *vmCompiler) constant(value float64) {
+	c.prog.constants = append(c.prog.constants, value)
+	c.emit(vmConst, len(c.prog.constants)-1, 0, 1)
+}
+
+// variable adds the variable of the identifier passed to the program and returns its slot and index.
+func (c *vmCompiler) variable(ident *Ident) (slot, index int) {
+	c.prog.variables = append(c.prog.variables, ident)
+	return c.slots[ident.Name], len(c.prog.variables) - 1
+}
+
+// compile compiles the node passed, emitting instructions that leave its value on top of the stack.
+func (c *vmCompiler) compile(n Node) error {
+	// Nodes are counted when they are entered, like BackendClosure does, which is before the first
+	// instruction emitted for them.
+	c.enter(n.Pos())
+	switch n := n.(type) {
+	case *Number:
+		c.constant(n.Value)
+		c.check(n)
+	case *Ident:
+		slot, index := c.variable(n)
+		c.emit(vmVar, slot, index, 1)
+		c.check(n)
+	case *Unary:
+		return c.compileUnary(n)
+	case *Binary:
+		return c.compileBinary(n)
+	case *Call:
+		return c.compileCall(n)
+	default:
+		return fmt.Errorf("cannot parse unknown expression %T", n)
+	}
+	return nil
+}
+
+// compileUnary compiles a unary expression.
+func (c *vmCompiler) compileUnary(n *Unary) error {
+	if err := c.compile(n.X); err != nil {
+		return err
+	}
+	switch n.Op {
+	case OpAdd:
+		return nil
+	case OpSub:
+		c.emit(vmNeg, 0, 0, 0)
+	case OpNot:
+		c.emit(vmNot, 0, 0, 0)
+	case OpBitNot:
+		c.emit(vmBitNot, 0, 0, 0)
+	case OpFactorial:
+		c.emit(vmFactorial, 0, 0, 0)
+	default:
+		return fmt.Errorf("unknown unary operation '%v' (pos:%d)", n.Op, n.OpPos)
+	}
+	c.check(n)
+	return nil
+}
+
+// compileBinary compiles a binary expression. The logical operators are compiled into jumps, so that Y is
+// only evaluated if needed. If Y is a number or identifier, it is used by the instruction of the operation
+// directly instead of being pushed onto the stack first.
+func (c *vmCompiler) compileBinary(n *Binary) error {
+	if err := c.compile(n.X); err != nil {
+		return err
+	}
+	switch n.Op {
+	case OpLAnd, OpLOr:
+		// x && y: x; jz short; y; bool; jmp end; short: 0; end:
+		// x || y: x; jnz short; y; bool; jmp end; short: 1; end:
+		jump, short := vmJumpIfZero, 0.0
+		if n.Op == OpLOr {
+			jump, short = vmJumpIfNotZero, 1
+		}
+		shortJump := c.emit(jump, 0, 0, -1)
+		if err := c.compile(n.Y); err != nil {
+			return err
+		}
+		c.emit(vmBool, 0, 0, 0)
+		endJump := c.emit(vmJump, 0, 0, -1)
+		c.patch(shortJump)
+		c.constant(short)
+		c.patch(endJump)
+		return nil
+	}
+	op, ok := vmBinaryOps[n.Op]
+	if !ok {
+		return fmt.Errorf("unknown mathematical operation '%v' (pos:%d)", n.Op, n.OpPos)
+	}
+	var in instruction
+	switch y := n.Y.(type) {
+	case *Number:
+		if c.strict {
+			// Y must be checked on its own in strict math mode.
+			break
+		}
+		c.enter(y.ValuePos)
+		c.prog.constants = append(c.prog.constants, y.Value)
+		in = instruction{operand: operandConst, arg: int32(len(c.prog.constants) - 1)}
+	case *Ident:
+		if c.strict {
+			break
+		}
+		c.enter(y.NamePos)
+		slot, index := c.variable(y)
+		in = instruction{operand: operandVar, arg: int32(slot), n: int32(index)}
+	}
+	if in.operand == operandStack {
+		if err := c.compile(n.Y); err != nil {
+			return err
+		}
+		if c.strict && (op == vmQuo || op == vmRem) {
+			c.prog.nodes = append(c.prog.nodes, n)
+			c.emit(vmCheckDivisor, len(c.prog.nodes)-1, 0, 0)
+		}
+		c.emit(op, 0, 0, -1)
+	} else {
+		i := c.emit(op, 0, 0, 0)
+		in.op = op
+		c.prog.code[i] = in
+	}
+	c.check(n)
+	return nil
+}
+
+// compileCall compiles a call to a function or a built-in conditional.
+func (c *vmCompiler) compileCall(n *Call) error {
+	switch n.Name {
+	case "if", "ifs":
+		return c.compileConditional(n)
+	}
+	start, stack, pending := len(c.prog.code), c.stack, append([]int(nil), c.pending...)
+	for _, arg := range n.Args {
+		if err := c.compile(arg); err != nil {
+			return fmt.Errorf("error parsing function parameter: %v", err)
+		}
+	}
+	p := &astParser{functions: c.functions}
+	f, err := p.function(n)
+	if err != nil {
+		// The arguments are never evaluated if the function cannot be called, so their instructions are
+		// dropped again.
+		c.prog.code, c.stack, c.pending = c.prog.code[:start], stack, pending
+		c.prog.errs = append(c.prog.errs, err)
+		c.emit(vmError, len(c.prog.errs)-1, 0, 1)
+		return nil
+	}
+	c.prog.functions = append(c.prog.functions, vmFunc{function: f.function, contextFunction: f.contextFunction, call: n})
+	c.emit(vmCall, len(c.prog.functions)-1, len(n.Args), 1-len(n.Args))
+	c.check(n)
+	return nil
+}
+
+// compileConditional compiles a call to if or ifs. Both are compiled into a sequence of conditions followed
+// by jumps, so that only the value selected is evaluated:
+//
+//  cond1; jz next1; value1; jmp end; next1: cond2; jz next2; value2; jmp end; next2: default; end:
+//
+func (c *vmCompiler) compileConditional(n *Call) error {
+	if err := checkConditional(n); err != nil {
+		return err
+	}
+	var endJumps []int
+	for i := 0; i < len(n.Args)-1; i += 2 {
+		if err := c.compile(n.Args[i]); err != nil {
+			return fmt.Errorf("error parsing function parameter: %v", err)
+		}
+		nextJump := c.emit(vmJumpIfZero, 0, 0, -1)
+		if err := c.compile(n.Args[i+1]); err != nil {
+			return fmt.Errorf("error parsing function parameter: %v", err)
+		}
+		endJumps = append(endJumps, c.emit(vmJump, 0, 0, -1))
+		c.patch(nextJump)
+	}
+	if err := c.compile(n.Args[len(n.Args)-1]); err != nil {
+		return fmt.Errorf("error parsing function parameter: %v", err)
+	}
+	for _, i := range endJumps {
+		c.patch(i)
+	}
+	return nil
+}
+
+// run runs the program using the state passed and returns the value left on the stack. The value on top of
+// the stack is kept in acc, so that most instructions do not need to access the stack at all.
+func (prog *vmProgram) run(s *state) (float64, error) {
+	// The value below the first value pushed is also stored on the stack, hence the extra space needed.
+	if cap(s.args) < prog.stackSize+1 {
+		s.args = make([]float64, 0, prog.stackSize+1)
+	}
+	stack := s.args[:prog.stackSize+1]
+	code, constants, values, known := prog.code, prog.constants, s.values, s.known
+	sp, acc := 0, 0.0
+	for pc := 0; pc < len(code); pc++ {
+		in := &code[pc]
+		if in.op >= vmAdd {
+			x, y := acc, 0.0
+			switch in.operand {
+			case operandStack:
+				sp--
+				x, y = stack[sp], acc
+			case operandConst:
+				y = constants[in.arg]
+			default:
+				if !known[in.arg] {
+					if _, err := s.resolve(prog.variables[in.n], int(in.arg)); err != nil {
+						return math.NaN(), err
+					}
+				}
+				y = values[in.arg]
+			}
+			switch in.op {
+			case vmAdd:
+				acc = x + y
+			case vmSub:
+				acc = x - y
+			case vmMul:
+				acc = x * y
+			case vmQuo:
+				acc = x / y
+			case vmRem:
+				acc = math.Mod(x, y)
+			case vmPow:
+				acc = math.Pow(x, y)
+			case vmEql:
+				acc = boolToFloat64(x == y)
+			case vmNeq:
+				acc = boolToFloat64(x != y)
+			case vmLss:
+				acc = boolToFloat64(x < y)
+			case vmLeq:
+				acc = boolToFloat64(x <= y)
+			case vmGtr:
+				acc = boolToFloat64(x > y)
+			case vmGeq:
+				acc = boolToFloat64(x >= y)
+			}
+			continue
+		}
+		switch in.op {
+		case vmConst:
+			stack[sp] = acc
+			sp++
+			acc = constants[in.arg]
+		case vmVar:
+			if !known[in.arg] {
+				if _, err := s.resolve(prog.variables[in.n], int(in.arg)); err != nil {
+					return math.NaN(), err
+				}
+			}
+			stack[sp] = acc
+			sp++
+			acc = values[in.arg]
+		case vmCall:
+			f := &prog.functions[in.arg]
+			if s.done != nil {
+				if err := s.interrupted(f.call.NamePos); err != nil {
+					return math.NaN(), err
+				}
+			}
+			// The arguments are the n values on top of the stack, of which the last is held by acc.
+			stack[sp] = acc
+			sp++
+			start := sp - int(in.n)
+			s.call = f.call
+			if f.contextFunction != nil {
+				var err error
+				if acc, err = f.contextFunction(s.context(), stack[start:sp]...); err != nil {
+					return math.NaN(), &ErrFunc{Func: f.call.Name, Pos: f.call.NamePos, Err: err}
+				}
+			} else {
+				acc = f.function(stack[start:sp]...)
+			}
+			s.call = nil
+			sp = start
+		case vmError:
+			return math.NaN(), prog.errs[in.arg]
+		case vmJump:
+			pc = int(in.arg) - 1
+		case vmJumpIfZero:
+			sp--
+			if acc == 0 {
+				pc = int(in.arg) - 1
+			}
+			acc = stack[sp]
+		case vmJumpIfNotZero:
+			sp--
+			if acc != 0 {
+				pc = int(in.arg) - 1
+			}
+			acc = stack[sp]
+		case vmBool:
+			acc = boolToFloat64(acc != 0)
+		case vmCount:
+			for _, pos := range prog.positions[in.arg : in.arg+in.n] {
+				if err := s.count(pos, prog.maxOps); err != nil {
+					return math.NaN(), err
+				}
+			}
+		case vmCheck:
+			if err := checkFinite(prog.nodes[in.arg], acc); err != nil {
+				return math.NaN(), err
+			}
+		case vmCheckDivisor:
+			if acc == 0 {
+				return math.NaN(), &ErrDivisionByZero{Pos: prog.nodes[in.arg].Pos()}
+			}
+		case vmNeg:
+			acc = -acc
+		case vmNot:
+			acc = boolToFloat64(acc == 0)
+		case vmBitNot:
+			acc = float64(^int64(acc))
+		case vmFactorial:
+			acc = math.Gamma(acc + 1)
+		}
+	}
+	return acc, nil
+}